@@ -1,81 +1,827 @@
 package acdb
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/bits"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/mohanson/doa"
-	"github.com/mohanson/lru"
 )
 
+// ErrClosed is returned by operations on a closed Emerge.
+var ErrClosed = errors.New("acdb: closed")
+
+// ErrCorrupt is returned when a stored value fails an integrity check.
+var ErrCorrupt = errors.New("acdb: corrupt value")
+
+// ErrDiskFull is matched by the error of a write which failed because the disk is full. The error also wraps the error
+// of the file system.
+var ErrDiskFull = errors.New("acdb: disk full")
+
+type diskFullError struct {
+	err error
+}
+
+func (e *diskFullError) Error() string {
+	return "acdb: disk full: " + e.err.Error()
+}
+
+func (e *diskFullError) Is(target error) bool {
+	return target == ErrDiskFull
+}
+
+func (e *diskFullError) Unwrap() error {
+	return e.err
+}
+
+// ErrExpired is returned by ExpireDriver when a key has expired. It wraps ErrNotExist, so an expired key is a missing
+// key to callers which do not care.
+var ErrExpired = fmt.Errorf("acdb: expired: %w", os.ErrNotExist)
+
+// ErrInvalidKey is returned when a key is not acceptable.
+var ErrInvalidKey = errors.New("acdb: invalid key")
+
+// ErrOutdated is returned by SetTimestamped when the stored value is newer than the write.
+var ErrOutdated = errors.New("acdb: outdated write")
+
+// ErrUnsupported is returned when the driver does not support the operation.
+var ErrUnsupported = errors.New("acdb: unsupported operation")
+
+// ErrOverwrite is returned by a strict Emerge when a key is set again without being deleted first.
+var ErrOverwrite = errors.New("acdb: overwrite")
+
+// ErrReadOnly is returned when writing a key which is read only.
+var ErrReadOnly = errors.New("acdb: read only key")
+
+// ErrSchemaViolation is matched by the error of ValidateDriver when a value is rejected, the error also wraps the
+// reason given by the validator.
+var ErrSchemaViolation = errors.New("acdb: schema violation")
+
+type schemaError struct {
+	err error
+}
+
+func (e *schemaError) Error() string {
+	return "acdb: schema violation: " + e.err.Error()
+}
+
+func (e *schemaError) Is(target error) bool {
+	return target == ErrSchemaViolation
+}
+
+func (e *schemaError) Unwrap() error {
+	return e.err
+}
+
+// ErrStale is returned by GetFresh when the value is older than requested.
+var ErrStale = errors.New("acdb: stale value")
+
+// ErrTooManyWatchers is returned by Watch when the maximum number of watchers is reached.
+var ErrTooManyWatchers = errors.New("acdb: too many watchers")
+
+// ErrTimeout is returned by TimeoutDriver when an operation does not finish in time.
+var ErrTimeout = errors.New("acdb: timeout")
+
+// ErrTooLarge is returned when a value exceeds the size the driver is able to store.
+var ErrTooLarge = errors.New("acdb: value too large")
+
+// IsNotExist reports whether err tells that a key does not exist. Unlike os.IsNotExist it sees through wrapped errors,
+// so it holds for a miss returned by any stack of drivers and for the OpError of a Client.
+func IsNotExist(err error) bool {
+	return errors.Is(err, os.ErrNotExist)
+}
+
+// OpError is the error type returned by Client. It describes the operation and the key that failed, and wraps the
+// error of the driver, so errors.Is and errors.As still reach the cause.
+type OpError struct {
+	Op  string
+	Key string
+	Err error
+}
+
+func (e *OpError) Error() string {
+	if e.Key == "" {
+		return "acdb: " + e.Op + ": " + e.Err.Error()
+	}
+	return "acdb: " + e.Op + " " + e.Key + ": " + e.Err.Error()
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
 // Driver is the interface that wraps the Set/Get and Del method.
 //
 // Get gets and returns the bytes or any error encountered. If the key does not exist, ErrNotExist will be returned.
 // Set sets bytes with given k.
-// Del dels bytes with given k. If the key does not exist, ErrNotExist will be returned.
+// Del dels bytes with given k. If the key does not exist, ErrNotExist will be returned. All built-in drivers follow
+// this, so code handling a missing key works the same whichever driver is used.
+//
+// Drivers are not concurrency-safety unless documented otherwise: even a Get may mutate the driver, e.g. LruDriver
+// reorders its entries on every Get. Wrap a driver with Emerge, which serializes all operations, before sharing it
+// between goroutines. ShardedLruDriver is concurrency-safety by itself. MapDriver counters, Attach subscriptions and
+// the snapshots of a persisted MemDriver are synchronized internally, but the operations still need Emerge. Methods
+// beyond Driver which are not documented as safe to call concurrently, e.g. VersionedDriver.Rollback, must be called
+// with Emerge.Do once the driver is shared.
 type Driver interface {
 	Get(k string) ([]byte, error)
 	Set(k string, v []byte) error
 	Del(k string) error
 }
 
+// Streamer is the interface implemented by drivers that can write a value to an io.Writer without buffering the whole
+// value in memory. If the key does not exist, ErrNotExist will be returned before anything is written.
+type Streamer interface {
+	GetTo(k string, w io.Writer) (int64, error)
+}
+
+// Opener is the interface implemented by drivers that can open a value for random access reading, e.g. to serve range
+// requests. The caller must close the returned reader.
+type Opener interface {
+	Open(k string) (io.ReadSeekCloser, error)
+}
+
+// bytesReader is a io.ReadSeekCloser over a value in memory.
+type bytesReader struct {
+	*bytes.Reader
+}
+
+func (bytesReader) Close() error {
+	return nil
+}
+
+// DirectGetter is the interface implemented by caching drivers that can bypass their cache and read the value from the
+// backing store.
+type DirectGetter interface {
+	GetDirect(k string) ([]byte, error)
+}
+
+// Lister is the interface implemented by drivers that can list all their keys. The order of keys is unspecified.
+type Lister interface {
+	Keys() ([]string, error)
+}
+
+// ModTimer is the interface implemented by drivers that know when a value was last set.
+type ModTimer interface {
+	ModTime(k string) (time.Time, error)
+}
+
+// Snapshotter is the interface implemented by drivers that can copy all their values at a point in time quickly, so
+// the copy can be read without blocking writes.
+type Snapshotter interface {
+	Snapshot() (map[string][]byte, error)
+}
+
+// Expirer is the interface implemented by drivers that can store a value which expires at a given time.
+type Expirer interface {
+	SetExpire(k string, v []byte, t time.Time) error
+}
+
+// Poller is the interface implemented by drivers that can find changes made to their storage by others. Poll checks
+// the storage every interval and calls f with every key changed or removed by others, until stop is called.
+type Poller interface {
+	Poll(interval time.Duration, f func(k string, deleted bool)) (stop func())
+}
+
+// KeyLimiter is the interface implemented by drivers which can not store keys longer than MaxKeyLen bytes.
+type KeyLimiter interface {
+	MaxKeyLen() int
+}
+
 // MemDriver cares to store data on memory, this means that MemDriver is fast. Since there is no expiration mechanism,
 // be careful that it might eats up all your memory.
 type MemDriver struct {
-	data map[string][]byte
+	data    map[string]memEntry
+	copy    bool
+	untimed bool
+	lock    *sync.Mutex
+	stop    chan struct{}
+	exit    chan error
+}
+
+// memEntry is a value with the time it was set. Keeping both in a single map costs one map assignment per Set.
+type memEntry struct {
+	v []byte
+	t time.Time
 }
 
-// NewMemDriver returns a MemDriver.
+// NewMemDriver returns a MemDriver. It stores and returns the very slices it is given, so the caller must not modify a
+// value after Set or after Get, or the stored value changes too.
 func NewMemDriver() *MemDriver {
 	return &MemDriver{
-		data: map[string][]byte{},
+		data: map[string]memEntry{},
+	}
+}
+
+// NewMemDriverCopy returns a MemDriver which copies values on both Set and Get, so callers are free to modify them. It
+// costs an allocation and a copy per operation.
+func NewMemDriverCopy() *MemDriver {
+	d := NewMemDriver()
+	d.copy = true
+	return d
+}
+
+// NewMemDriverUntimed returns a MemDriver which does not record when values are set, ModTime fails with
+// ErrUnsupported. Reading the clock is the largest cost of a Set of a small value, so it suits hot loops which never
+// need GetFresh.
+func NewMemDriverUntimed() *MemDriver {
+	d := NewMemDriver()
+	d.untimed = true
+	return d
+}
+
+// NewMemDriverPersisted returns a MemDriver which loads the snapshot at name if there is one, then writes a snapshot
+// of all data to name every interval in the background and once more on Close. A crash loses at most the writes of the
+// last interval. Snapshots are written to a temporary file and renamed, so a crash during a snapshot keeps the previous
+// one. The snapshot holds no times, so loaded values have a zero ModTime and count as stale for GetFresh.
+func NewMemDriverPersisted(name string, interval time.Duration) *MemDriver {
+	d := NewMemDriver()
+	b, err := os.ReadFile(name)
+	if err == nil {
+		m := map[string][]byte{}
+		doa.Try1(json.Unmarshal(b, &m))
+		for k, v := range m {
+			d.data[k] = memEntry{v: v}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		doa.Try1(err)
+	}
+	d.lock = &sync.Mutex{}
+	d.stop = make(chan struct{})
+	d.exit = make(chan error, 1)
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		var err error
+		for {
+			select {
+			case <-t.C:
+				err = d.snapshot(name)
+			case <-d.stop:
+				if e := d.snapshot(name); e != nil {
+					err = e
+				}
+				d.exit <- err
+				return
+			}
+		}
+	}()
+	return d
+}
+
+func (d *MemDriver) snapshot(name string) error {
+	d.lock.Lock()
+	m := make(map[string][]byte, len(d.data))
+	for k, e := range d.data {
+		m[k] = e.v
+	}
+	d.lock.Unlock()
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(name+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// Close stops the background snapshots of a driver created by NewMemDriverPersisted and writes the final snapshot. It
+// returns the error of the last failed snapshot, if any. For other MemDrivers it does nothing.
+func (d *MemDriver) Close() error {
+	if d.stop == nil {
+		return nil
 	}
+	close(d.stop)
+	return <-d.exit
 }
 
 func (d *MemDriver) Get(k string) ([]byte, error) {
-	v, b := d.data[k]
+	if d.lock != nil {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+	}
+	e, b := d.data[k]
 	if b {
-		return v, nil
+		if d.copy {
+			return append([]byte{}, e.v...), nil
+		}
+		return e.v, nil
 	}
 	return nil, os.ErrNotExist
 }
 
 func (d *MemDriver) Set(k string, v []byte) error {
-	d.data[k] = v
+	if d.lock != nil {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+	}
+	if d.copy {
+		v = append([]byte{}, v...)
+	}
+	if d.untimed {
+		d.data[k] = memEntry{v: v}
+		return nil
+	}
+	d.data[k] = memEntry{v: v, t: time.Now()}
 	return nil
 }
 
 func (d *MemDriver) Del(k string) error {
+	if d.lock != nil {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+	}
+	if _, b := d.data[k]; !b {
+		return os.ErrNotExist
+	}
 	delete(d.data, k)
 	return nil
 }
 
+// ModTime returns the time k was last set. Values loaded from a snapshot have the zero time.
+func (d *MemDriver) ModTime(k string) (time.Time, error) {
+	if d.lock != nil {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+	}
+	if d.untimed {
+		return time.Time{}, ErrUnsupported
+	}
+	e, b := d.data[k]
+	if !b {
+		return time.Time{}, os.ErrNotExist
+	}
+	return e.t, nil
+}
+
+// Snapshot copies the map of values. The values themselves are shared, which is safe since they are replaced rather
+// than modified by Set.
+func (d *MemDriver) Snapshot() (map[string][]byte, error) {
+	if d.lock != nil {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+	}
+	r := make(map[string][]byte, len(d.data))
+	for k, e := range d.data {
+		r[k] = e.v
+	}
+	return r, nil
+}
+
+func (d *MemDriver) Keys() ([]string, error) {
+	if d.lock != nil {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+	}
+	r := make([]string, 0, len(d.data))
+	for k := range d.data {
+		r = append(r, k)
+	}
+	return r, nil
+}
+
+func (d *MemDriver) GetTo(k string, w io.Writer) (int64, error) {
+	v, err := d.Get(k)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(v)
+	return int64(n), err
+}
+
+// PartitionedMemDriver partitions keys across several MemDrivers by the hash of the key. Each partition has its own map
+// and lock, so unlike MemDriver it is concurrency-safety by itself, and operations on keys of different partitions do
+// not contend. Use it directly rather than through Emerge, whose single lock would serialize it again.
+type PartitionedMemDriver struct {
+	partitions []*memPartition
+}
+
+type memPartition struct {
+	m   sync.RWMutex
+	mem *MemDriver
+}
+
+// NewPartitionedMemDriver returns a PartitionedMemDriver. A partitions less than 1 means a single partition.
+func NewPartitionedMemDriver(partitions int) *PartitionedMemDriver {
+	if partitions < 1 {
+		partitions = 1
+	}
+	d := &PartitionedMemDriver{
+		partitions: make([]*memPartition, partitions),
+	}
+	for i := range d.partitions {
+		d.partitions[i] = &memPartition{mem: NewMemDriver()}
+	}
+	return d
+}
+
+func (d *PartitionedMemDriver) partition(k string) *memPartition {
+	h := fnv.New32a()
+	h.Write([]byte(k))
+	return d.partitions[h.Sum32()%uint32(len(d.partitions))]
+}
+
+func (d *PartitionedMemDriver) Get(k string) ([]byte, error) {
+	p := d.partition(k)
+	p.m.RLock()
+	defer p.m.RUnlock()
+	return p.mem.Get(k)
+}
+
+func (d *PartitionedMemDriver) Set(k string, v []byte) error {
+	p := d.partition(k)
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.mem.Set(k, v)
+}
+
+func (d *PartitionedMemDriver) Del(k string) error {
+	p := d.partition(k)
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.mem.Del(k)
+}
+
+// Keys returns the keys of all partitions. Each partition is listed under its own lock, so the result is not a point
+// in time view if keys are changed meanwhile.
+func (d *PartitionedMemDriver) Keys() ([]string, error) {
+	var r []string
+	for _, p := range d.partitions {
+		p.m.RLock()
+		l, _ := p.mem.Keys()
+		p.m.RUnlock()
+		r = append(r, l...)
+	}
+	return r, nil
+}
+
+// PathMapper maps a key to a file path relative to the root of DocDriver.
+type PathMapper func(k string) string
+
 // DocDriver use the OS's file system to manage data. In general, any high frequency operation is not recommended
 // unless you have an enough reason.
 type DocDriver struct {
-	root string
+	root   string
+	mapper PathMapper
+	invert func(p string) (string, error)
+	limit  *docLimit
+	prune  bool
+	poll   *docPoll
+}
+
+// docLimit tracks the files of a byte capped DocDriver, ordered by modification time with the oldest first.
+type docLimit struct {
+	max   int64
+	used  int64
+	order *list.List
+	index map[string]*list.Element
+}
+
+type docFile struct {
+	path string
+	size int64
+}
+
+// docPoll is the state of the files under root as last seen by Poll or written by the driver itself, by path.
+type docPoll struct {
+	m    sync.Mutex
+	seen map[string]docStat
+}
+
+type docStat struct {
+	mod  time.Time
+	size int64
 }
 
 // NewDocDriver returns a DocDriver.
 func NewDocDriver(root string) *DocDriver {
+	return NewDocDriverMapper(root, func(k string) string { return k })
+}
+
+// NewDocDriverMapper returns a DocDriver which stores the value of k in the file mapper(k) under root. Missing parent
+// directories are created on Set.
+func NewDocDriverMapper(root string, mapper PathMapper) *DocDriver {
 	doa.Try1(os.MkdirAll(root, 0755))
 	return &DocDriver{
-		root: root,
+		root:   root,
+		mapper: mapper,
+	}
+}
+
+// NewDocDriverBase64 returns a DocDriver which names files by the unpadded base64url encoding of keys, so any byte
+// sequence, including slashes and null bytes, is a valid key. Unlike hashing the encoding is reversible and Keys
+// returns the original keys. Since most file systems limit names to 255 bytes, keys longer than 191 bytes can not be
+// stored.
+func NewDocDriverBase64(root string) *DocDriver {
+	d := NewDocDriverMapper(root, func(k string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(k))
+	})
+	d.invert = func(p string) (string, error) {
+		b, err := base64.RawURLEncoding.DecodeString(p)
+		return string(b), err
+	}
+	return d
+}
+
+// NewDocDriverByteCapped returns a DocDriver which keeps the total size of files under root within maxBytes. When a Set
+// would exceed the budget, the oldest files by modification time are removed first. The root is scanned once here,
+// after that a running total is maintained, so files must not be changed by others. A value larger than maxBytes is
+// rejected with ErrTooLarge.
+func NewDocDriverByteCapped(root string, maxBytes int64) *DocDriver {
+	d := NewDocDriver(root)
+	d.limit = &docLimit{
+		max:   maxBytes,
+		order: list.New(),
+		index: map[string]*list.Element{},
+	}
+	type file struct {
+		docFile
+		time time.Time
+	}
+	l := []file{}
+	doa.Try1(filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			l = append(l, file{docFile{path.Clean(filepath.ToSlash(p)), info.Size()}, info.ModTime()})
+		}
+		return nil
+	}))
+	sort.Slice(l, func(i, j int) bool { return l[i].time.Before(l[j].time) })
+	for _, e := range l {
+		d.limit.index[e.path] = d.limit.order.PushBack(e.docFile)
+		d.limit.used += e.size
+	}
+	return d
+}
+
+// reserve makes room for a file of size bytes at p by removing the oldest files, and records it as the newest file.
+func (d *DocDriver) reserve(p string, size int64) error {
+	if size > d.limit.max {
+		return ErrTooLarge
+	}
+	d.release(p)
+	for d.limit.used+size > d.limit.max {
+		e := d.limit.order.Front().Value.(docFile)
+		if err := os.Remove(e.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		d.release(e.path)
+		if d.poll != nil {
+			delete(d.poll.seen, e.path)
+		}
+	}
+	d.limit.index[p] = d.limit.order.PushBack(docFile{p, size})
+	d.limit.used += size
+	return nil
+}
+
+// release forgets the file at p.
+func (d *DocDriver) release(p string) {
+	if e, b := d.limit.index[p]; b {
+		d.limit.used -= e.Value.(docFile).size
+		d.limit.order.Remove(e)
+		delete(d.limit.index, p)
 	}
 }
 
+func (d *DocDriver) path(k string) string {
+	return path.Join(d.root, d.mapper(k))
+}
+
+// MaxKeyLen returns 255, the usual limit of file names.
+func (d *DocDriver) MaxKeyLen() int {
+	return 255
+}
+
 func (d *DocDriver) Get(k string) ([]byte, error) {
-	return os.ReadFile(path.Join(d.root, k))
+	return os.ReadFile(d.path(k))
 }
 
 func (d *DocDriver) Set(k string, v []byte) error {
-	return os.WriteFile(path.Join(d.root, k), v, 0644)
+	p := d.path(k)
+	if d.poll != nil {
+		d.poll.m.Lock()
+		defer d.poll.m.Unlock()
+		defer d.record(p)
+	}
+	if d.limit != nil {
+		if err := d.reserve(p, int64(len(v))); err != nil {
+			return err
+		}
+	}
+	// The parent directory usually exists, create it only when the write fails without it.
+	err := os.WriteFile(p, v, 0644)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			return err
+		}
+		err = os.WriteFile(p, v, 0644)
+	}
+	if err != nil && d.limit != nil {
+		d.release(p)
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		// The file is truncated and partly written, remove it rather than leave a corrupt value behind.
+		os.Remove(p)
+		return &diskFullError{err}
+	}
+	return err
 }
 
 func (d *DocDriver) Del(k string) error {
-	return os.Remove(path.Join(d.root, k))
+	p := d.path(k)
+	if d.poll != nil {
+		d.poll.m.Lock()
+		defer d.poll.m.Unlock()
+		defer d.record(p)
+	}
+	if d.limit != nil {
+		d.release(p)
+	}
+	if err := os.Remove(p); err != nil {
+		return err
+	}
+	if d.prune {
+		// Removing a directory fails unless it is empty, which stops the pruning at the first one still in use.
+		root := path.Clean(d.root)
+		for dir := path.Dir(p); dir != root && dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// record notes the state of the file at p as seen, so Poll does not report it. It must be called with the lock of
+// poll held.
+func (d *DocDriver) record(p string) {
+	info, err := os.Stat(p)
+	if err != nil {
+		delete(d.poll.seen, p)
+		return
+	}
+	d.poll.seen[p] = docStat{info.ModTime(), info.Size()}
+}
+
+// Poll scans the files under root every interval and calls f with the key of every file created, changed or removed
+// by others since the previous scan, as Keys would return it. Changes are found by the size and the modification time
+// of files, a change keeping both is missed. Writes made through the driver are not reported. Scanning costs a walk of
+// the whole root, so polling is off unless started, and it must be started before the driver is used by others. The
+// returned function stops polling.
+func (d *DocDriver) Poll(interval time.Duration, f func(k string, deleted bool)) func() {
+	d.poll = &docPoll{seen: map[string]docStat{}}
+	d.scan(nil)
+	stop := make(chan struct{})
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				d.scan(f)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(stop) }) }
+}
+
+// scan compares the files under root with the ones seen before, records them and reports the differences to f. Every
+// file is checked under the lock of poll, so a concurrent write of the driver is never mistaken for a change by others.
+// f is called without the lock held.
+func (d *DocDriver) scan(f func(k string, deleted bool)) {
+	l := map[string]struct{}{}
+	filepath.Walk(d.root, func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			l[path.Clean(filepath.ToSlash(p))] = struct{}{}
+		}
+		return nil
+	})
+	d.poll.m.Lock()
+	for p := range d.poll.seen {
+		if _, b := l[p]; !b {
+			l[p] = struct{}{}
+		}
+	}
+	d.poll.m.Unlock()
+	for p := range l {
+		d.poll.m.Lock()
+		old, b := d.poll.seen[p]
+		d.record(p)
+		now, c := d.poll.seen[p]
+		d.poll.m.Unlock()
+		if f == nil || (b == c && old == now) {
+			continue
+		}
+		rel, err := filepath.Rel(d.root, filepath.FromSlash(p))
+		if err != nil {
+			continue
+		}
+		k := filepath.ToSlash(rel)
+		if d.invert != nil {
+			if k, err = d.invert(k); err != nil {
+				continue
+			}
+		}
+		f(k, !c)
+	}
+}
+
+// SetPrune makes Del remove the parent directories of the file which become empty, up to the root. Set creates parent
+// directories for keys containing slashes as needed, so without pruning they are left behind once their keys are gone.
+func (d *DocDriver) SetPrune(b bool) {
+	d.prune = b
+}
+
+// Keys returns the paths of all files under root, relative to root and separated by slashes. They are the keys only if
+// the PathMapper is the identity or the driver is created by NewDocDriverBase64.
+func (d *DocDriver) Keys() ([]string, error) {
+	r := []string{}
+	err := filepath.Walk(d.root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(d.root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.invert != nil {
+			rel, err = d.invert(rel)
+			if err != nil {
+				return err
+			}
+		}
+		r = append(r, rel)
+		return nil
+	})
+	return r, err
+}
+
+// ModTime returns the modification time of the file of k.
+func (d *DocDriver) ModTime(k string) (time.Time, error) {
+	info, err := os.Stat(d.path(k))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// Open opens the file of k. The file is read after the lock of Emerge is released, so a concurrent Set of the same key
+// may be observed partially.
+func (d *DocDriver) Open(k string) (io.ReadSeekCloser, error) {
+	return os.Open(d.path(k))
+}
+
+func (d *DocDriver) GetTo(k string, w io.Writer) (int64, error) {
+	f, err := os.Open(d.path(k))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
 }
 
 // In computing, cache algorithms (also frequently called cache replacement algorithms or cache replacement policies)
@@ -87,136 +833,4133 @@ func (d *DocDriver) Del(k string) error {
 // Least recently used (LRU), discards the least recently used items first. It has a fixed size(for limit memory usages)
 // and O(1) time lookup.
 type LruDriver struct {
-	data *lru.Cache
+	bytes int64
+	size  int
+	order *list.List
+	index map[string]*list.Element
+	evict chan EvictEvent
+}
+
+type lruEntry struct {
+	k string
+	v []byte
+	t time.Time
 }
 
-// NewLruDriver returns a LruDriver.
+// EvictEvent reports that a key was evicted from a cache to make room for another one.
+type EvictEvent struct {
+	Key string
+}
+
+// NewLruDriver returns a LruDriver. A size of 0 caches nothing, every Set is evicted at once, and a size less than 0
+// means 0.
 func NewLruDriver(size int) *LruDriver {
+	if size < 0 {
+		size = 0
+	}
 	return &LruDriver{
-		data: lru.New(size),
+		size:  size,
+		order: list.New(),
+		index: map[string]*list.Element{},
+		evict: make(chan EvictEvent, 64),
 	}
 }
 
+// Evictions returns a channel receiving an EvictEvent for every evicted key. Events are sent without blocking: when the
+// buffer of the channel is full, because nobody receives or the receiver is slow, further events are dropped. So it
+// suits monitoring, not bookkeeping that must see every eviction.
+func (d *LruDriver) Evictions() <-chan EvictEvent {
+	return d.evict
+}
+
 func (d *LruDriver) Get(k string) ([]byte, error) {
-	v, b := d.data.Get(k)
+	e, b := d.index[k]
 	if b {
-		return v.([]byte), nil
+		d.order.MoveToFront(e)
+		return e.Value.(*lruEntry).v, nil
 	}
 	return nil, os.ErrNotExist
 }
 
 func (d *LruDriver) Set(k string, v []byte) error {
-	d.data.Set(k, v)
+	if e, b := d.index[k]; b {
+		d.order.MoveToFront(e)
+		atomic.AddInt64(&d.bytes, int64(len(v)-len(e.Value.(*lruEntry).v)))
+		e.Value.(*lruEntry).v = v
+		e.Value.(*lruEntry).t = time.Now()
+		return nil
+	}
+	if d.size > 0 && d.order.Len() >= d.size {
+		// Reuse the entry of the evicted key, which saves two allocations per Set on a full cache.
+		e := d.order.Back()
+		x := e.Value.(*lruEntry)
+		d.evicted(x)
+		*x = lruEntry{k: k, v: v, t: time.Now()}
+		d.order.MoveToFront(e)
+		d.index[k] = e
+		atomic.AddInt64(&d.bytes, int64(len(k)+len(v)))
+		return nil
+	}
+	d.index[k] = d.order.PushFront(&lruEntry{k: k, v: v, t: time.Now()})
+	atomic.AddInt64(&d.bytes, int64(len(k)+len(v)))
+	for d.order.Len() > d.size {
+		d.evicted(d.order.Remove(d.order.Back()).(*lruEntry))
+	}
 	return nil
 }
 
+// evicted forgets the entry e and reports its eviction. The caller removes it from the order.
+func (d *LruDriver) evicted(e *lruEntry) {
+	delete(d.index, e.k)
+	atomic.AddInt64(&d.bytes, -int64(len(e.k)+len(e.v)))
+	select {
+	case d.evict <- EvictEvent{Key: e.k}:
+	default:
+	}
+}
+
 func (d *LruDriver) Del(k string) error {
-	d.data.Del(k)
+	e, b := d.index[k]
+	if !b {
+		return os.ErrNotExist
+	}
+	d.order.Remove(e)
+	delete(d.index, k)
+	atomic.AddInt64(&d.bytes, -int64(len(k)+len(e.Value.(*lruEntry).v)))
 	return nil
 }
 
-// MapDriver is based on DocDriver and use LruDriver to provide caching at its
-// interface layer. The size of LruDriver is always 1024.
-type MapDriver struct {
-	doc *DocDriver
-	lru *LruDriver
+// ModTime returns the time k was last set. It does not count as a use of the key.
+func (d *LruDriver) ModTime(k string) (time.Time, error) {
+	e, b := d.index[k]
+	if !b {
+		return time.Time{}, os.ErrNotExist
+	}
+	return e.Value.(*lruEntry).t, nil
 }
 
-// NewMapDriver returns a MapDriver.
-func NewMapDriver(root string) *MapDriver {
-	return &MapDriver{
-		doc: NewDocDriver(root),
-		lru: NewLruDriver(1024),
+// Bytes returns the total size of the cached keys and values. It is maintained on every change rather than computed,
+// and is safe to call concurrently with other operations.
+func (d *LruDriver) Bytes() int64 {
+	return atomic.LoadInt64(&d.bytes)
+}
+
+func (d *LruDriver) GetTo(k string, w io.Writer) (int64, error) {
+	v, err := d.Get(k)
+	if err != nil {
+		return 0, err
 	}
+	n, err := w.Write(v)
+	return int64(n), err
 }
 
-func (d *MapDriver) Get(k string) ([]byte, error) {
-	var (
-		buf []byte
-		err error
-	)
-	buf, err = d.lru.Get(k)
-	if err == nil {
-		return buf, nil
+// SpillingLruDriver is a LruDriver which writes evicted entries to a spill driver, e.g. a DocDriver, instead of
+// dropping them, so memory is bounded but nothing is lost. A Get missing the cache falls back to the spill driver and
+// promotes the value back into the cache. The spill driver may hold stale copies of cached keys, they are never read
+// since the cache comes first. An entry is spilled before it is evicted, and stays cached if spilling fails.
+type SpillingLruDriver struct {
+	lru   *LruDriver
+	spill Driver
+}
+
+// NewSpillingLruDriver returns a SpillingLruDriver. A size less than 1 means 1.
+func NewSpillingLruDriver(size int, spill Driver) *SpillingLruDriver {
+	if size < 1 {
+		size = 1
 	}
-	buf, err = d.doc.Get(k)
+	return &SpillingLruDriver{
+		lru:   NewLruDriver(size),
+		spill: spill,
+	}
+}
+
+// room spills the least recently used entry if caching k would evict it, so it is safe in the spill driver before it
+// leaves the cache.
+func (d *SpillingLruDriver) room(k string) error {
+	if _, b := d.lru.index[k]; b || d.lru.order.Len() < d.lru.size {
+		return nil
+	}
+	e := d.lru.order.Back().Value.(*lruEntry)
+	return d.spill.Set(e.k, e.v)
+}
+
+// Get returns the cached value, or the spilled one which is then promoted back into the cache. If making room for the
+// promoted value fails, the value is returned all the same and stays in the spill driver only.
+func (d *SpillingLruDriver) Get(k string) ([]byte, error) {
+	if v, err := d.lru.Get(k); err == nil {
+		return v, nil
+	}
+	v, err := d.spill.Get(k)
 	if err != nil {
 		return nil, err
 	}
-	err = d.lru.Set(k, buf)
-	return buf, err
+	if d.room(k) == nil {
+		d.lru.Set(k, v)
+	}
+	return v, nil
 }
 
-func (d *MapDriver) Set(k string, v []byte) error {
-	if err := d.lru.Set(k, v); err != nil {
+// Set caches the value. If the cache is full and the least recently used entry fails to spill, the error is returned,
+// the entry stays cached and the value is not set.
+func (d *SpillingLruDriver) Set(k string, v []byte) error {
+	if err := d.room(k); err != nil {
 		return err
 	}
-	if err := d.doc.Set(k, v); err != nil {
-		return err
-	}
-	return nil
+	return d.lru.Set(k, v)
 }
 
-func (d *MapDriver) Del(k string) error {
-	if err := d.lru.Del(k); err != nil {
-		return err
+func (d *SpillingLruDriver) Del(k string) error {
+	a := d.lru.Del(k)
+	b := d.spill.Del(k)
+	if b != nil && !errors.Is(b, os.ErrNotExist) {
+		return b
 	}
-	if err := d.doc.Del(k); err != nil {
-		return err
+	if a != nil && b != nil {
+		return os.ErrNotExist
 	}
 	return nil
 }
 
-type Client interface {
-	Get(k string) ([]byte, error)
-	Set(k string, v []byte) error
-	GetDecode(string, interface{}) error
-	SetEncode(string, interface{}) error
-	Del(k string) error
+// ShardedLruDriver partitions keys across several LruDrivers by the hash of the key. Each shard has its own lock, so
+// unlike other drivers it is concurrency-safety by itself, and operations on different shards do not contend. The total
+// capacity is size, split evenly across shards, so a shard holds size/shards keys or one more.
+type ShardedLruDriver struct {
+	shards []*lruShard
 }
 
-// Emerge is a actuator of the given drive. Do not worry, Is's concurrency-safety.
-type Emerge struct {
-	driver Driver
-	m      *sync.Mutex
+type lruShard struct {
+	m   sync.Mutex
+	lru *LruDriver
+}
+
+// NewShardedLruDriver returns a ShardedLruDriver. A shards less than 1 means a single shard, and a shards more than
+// size is reduced to size, so no shard is left without room.
+func NewShardedLruDriver(size int, shards int) *ShardedLruDriver {
+	if shards > size {
+		shards = size
+	}
+	if shards < 1 {
+		shards = 1
+	}
+	d := &ShardedLruDriver{
+		shards: make([]*lruShard, shards),
+	}
+	for i := range d.shards {
+		n := size / shards
+		if i < size%shards {
+			n++
+		}
+		d.shards[i] = &lruShard{lru: NewLruDriver(n)}
+	}
+	return d
+}
+
+func (d *ShardedLruDriver) shard(k string) *lruShard {
+	h := fnv.New32a()
+	h.Write([]byte(k))
+	return d.shards[h.Sum32()%uint32(len(d.shards))]
+}
+
+func (d *ShardedLruDriver) Get(k string) ([]byte, error) {
+	s := d.shard(k)
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.lru.Get(k)
+}
+
+func (d *ShardedLruDriver) Set(k string, v []byte) error {
+	s := d.shard(k)
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.lru.Set(k, v)
+}
+
+func (d *ShardedLruDriver) Del(k string) error {
+	s := d.shard(k)
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.lru.Del(k)
+}
+
+// SampledLruDriver is an approximate LruDriver. A Get only stamps the entry with a counter instead of reordering a
+// list, and when the cache is full it evicts the least recently used of samples randomly picked entries, like Redis
+// does. A larger samples evicts closer to exact LRU at a higher cost per eviction, 5 is a good start.
+type SampledLruDriver struct {
+	size    int
+	samples int
+	clock   uint64
+	seed    uint64
+	entries []sampledEntry
+	index   map[string]int
+}
+
+type sampledEntry struct {
+	k string
+	v []byte
+	t uint64
+}
+
+// NewSampledLruDriver returns a SampledLruDriver.
+func NewSampledLruDriver(size int, samples int) *SampledLruDriver {
+	if samples < 1 {
+		samples = 1
+	}
+	return &SampledLruDriver{
+		size:    size,
+		samples: samples,
+		seed:    uint64(time.Now().UnixNano()) | 1,
+		index:   map[string]int{},
+	}
+}
+
+// rand returns a pseudo random number in [0, n) by xorshift, which is good enough to pick samples.
+func (d *SampledLruDriver) rand(n int) int {
+	d.seed ^= d.seed << 13
+	d.seed ^= d.seed >> 7
+	d.seed ^= d.seed << 17
+	return int(d.seed % uint64(n))
+}
+
+func (d *SampledLruDriver) Get(k string) ([]byte, error) {
+	i, b := d.index[k]
+	if !b {
+		return nil, os.ErrNotExist
+	}
+	d.clock++
+	d.entries[i].t = d.clock
+	return d.entries[i].v, nil
+}
+
+func (d *SampledLruDriver) Set(k string, v []byte) error {
+	d.clock++
+	if i, b := d.index[k]; b {
+		d.entries[i].v = v
+		d.entries[i].t = d.clock
+		return nil
+	}
+	if d.size < 1 {
+		return nil
+	}
+	if len(d.entries) >= d.size {
+		o := d.rand(len(d.entries))
+		for n := 1; n < d.samples; n++ {
+			if i := d.rand(len(d.entries)); d.entries[i].t < d.entries[o].t {
+				o = i
+			}
+		}
+		d.remove(o)
+	}
+	d.index[k] = len(d.entries)
+	d.entries = append(d.entries, sampledEntry{k: k, v: v, t: d.clock})
+	return nil
+}
+
+func (d *SampledLruDriver) Del(k string) error {
+	i, b := d.index[k]
+	if !b {
+		return os.ErrNotExist
+	}
+	d.remove(i)
+	return nil
+}
+
+// remove removes the entry at i by moving the last entry into its place.
+func (d *SampledLruDriver) remove(i int) {
+	delete(d.index, d.entries[i].k)
+	last := len(d.entries) - 1
+	if i != last {
+		d.entries[i] = d.entries[last]
+		d.index[d.entries[i].k] = i
+	}
+	d.entries[last] = sampledEntry{}
+	d.entries = d.entries[:last]
+}
+
+// MapDriver is based on DocDriver and use LruDriver to provide caching at its
+// interface layer. The size of LruDriver is always 1024.
+//
+// Writes are synchronous in every mode: Set and Del return only after both the cache and the file are updated, and the
+// cache never holds a value older than the file. So when all operations go through one Emerge, a Get always observes
+// the latest completed Set or Del, whether it is served by the cache or by the disk. The guarantee does not hold for
+// files changed by others behind the driver, the cache keeps serving the old value until the key is evicted.
+//
+// The cache holds copies of the values passed to Set and read from disk, so modifying them afterwards does not reach
+// the cache. A value returned by a cache hit is the cached one itself and must not be modified.
+type MapDriver struct {
+	hits     uint64
+	misses   uint64
+	errors   uint64
+	doc      *DocDriver
+	lru      Driver // A LruDriver of size entries, or a FaultDriver wrapping it in tests.
+	size     int
+	populate bool
+	inv      Invalidator
+	stale    map[string]struct{}
+	staleMu  sync.Mutex
+}
+
+// NewMapDriver returns a MapDriver.
+func NewMapDriver(root string) *MapDriver {
+	return &MapDriver{
+		doc:      NewDocDriver(root),
+		lru:      NewLruDriver(1024),
+		size:     1024,
+		populate: true,
+	}
+}
+
+// NewMapDriverWriteCache returns a MapDriver whose Get does not put values read from disk into the cache, only Set
+// does, so the cache holds the recently written keys rather than the recently read ones. It saves memory for write
+// heavy workloads that rarely read back.
+func NewMapDriverWriteCache(root string) *MapDriver {
+	d := NewMapDriver(root)
+	d.populate = false
+	return d
+}
+
+// Invalidator carries cache invalidations between MapDrivers sharing the same files, for example several servers on a
+// network file system. Publish announces that a key changed, Subscribe registers a function called with every key
+// published by the others. Delivery is best effort, the caches are eventually coherent at most.
+type Invalidator interface {
+	Publish(k string)
+	Subscribe(f func(k string))
+}
+
+// InvalidationBus is an in-process Invalidator transport. Every MapDriver joins the bus with its own endpoint.
+type InvalidationBus struct {
+	m    sync.Mutex
+	subs []*busEndpoint
+}
+
+type busEndpoint struct {
+	bus *InvalidationBus
+	f   func(k string)
+}
+
+// NewInvalidationBus returns a InvalidationBus.
+func NewInvalidationBus() *InvalidationBus {
+	return &InvalidationBus{}
+}
+
+// Join returns a new endpoint of the bus. Keys published by an endpoint are delivered to all other endpoints.
+func (b *InvalidationBus) Join() Invalidator {
+	e := &busEndpoint{bus: b}
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.subs = append(b.subs, e)
+	return e
+}
+
+func (e *busEndpoint) Publish(k string) {
+	e.bus.m.Lock()
+	defer e.bus.m.Unlock()
+	for _, s := range e.bus.subs {
+		if s != e && s.f != nil {
+			s.f(k)
+		}
+	}
+}
+
+func (e *busEndpoint) Subscribe(f func(k string)) {
+	e.bus.m.Lock()
+	defer e.bus.m.Unlock()
+	e.f = f
+}
+
+// Attach connects the driver to an Invalidator. Every Set and Del is published, and keys published by others are
+// dropped from the cache before the next operation, so the next Get reads them from disk.
+func (d *MapDriver) Attach(i Invalidator) {
+	d.staleMu.Lock()
+	d.inv = i
+	d.staleMu.Unlock()
+	i.Subscribe(d.invalidate)
+}
+
+// invalidate marks k as changed by others, it is dropped from the cache before the next operation.
+func (d *MapDriver) invalidate(k string) {
+	d.staleMu.Lock()
+	defer d.staleMu.Unlock()
+	if d.stale == nil {
+		d.stale = map[string]struct{}{}
+	}
+	d.stale[k] = struct{}{}
+}
+
+// Poll watches the files for changes made by others like DocDriver.Poll does. Changed keys are dropped from the cache
+// before the next operation, then f is called.
+func (d *MapDriver) Poll(interval time.Duration, f func(k string, deleted bool)) func() {
+	return d.doc.Poll(interval, func(k string, deleted bool) {
+		d.invalidate(k)
+		f(k, deleted)
+	})
+}
+
+// drain drops the keys invalidated by others from the cache.
+func (d *MapDriver) drain() {
+	d.staleMu.Lock()
+	defer d.staleMu.Unlock()
+	for k := range d.stale {
+		d.lru.Del(k)
+		delete(d.stale, k)
+	}
+}
+
+// publish announces a change of k to the others, if the driver is attached to an Invalidator.
+func (d *MapDriver) publish(k string) {
+	if d.inv != nil {
+		d.inv.Publish(k)
+	}
+}
+
+// disk counts err as a disk error unless it is nil or ErrNotExist, and returns it unchanged.
+func (d *MapDriver) disk(err error) error {
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		atomic.AddUint64(&d.errors, 1)
+	}
+	return err
+}
+
+func (d *MapDriver) Get(k string) ([]byte, error) {
+	buf, _, err := d.GetCached(k)
+	return buf, err
+}
+
+// GetCached is like Get, and also reports whether the value came from the cache rather than from disk.
+func (d *MapDriver) GetCached(k string) ([]byte, bool, error) {
+	var (
+		buf []byte
+		err error
+	)
+	d.drain()
+	buf, err = d.lru.Get(k)
+	if err == nil {
+		atomic.AddUint64(&d.hits, 1)
+		return buf, true, nil
+	}
+	atomic.AddUint64(&d.misses, 1)
+	buf, err = d.doc.Get(k)
+	if err != nil {
+		return nil, false, d.disk(err)
+	}
+	if d.populate {
+		// The disk is the source of truth, failing to cache the value must not fail the read. The cache keeps its own
+		// copy, so the caller may modify the value read from disk.
+		d.lru.Set(k, append([]byte{}, buf...))
+	}
+	return buf, false, nil
+}
+
+// Set writes the file first and the cache second. The disk is the source of truth: a failure of the cache is not
+// reported, the key is dropped from the cache instead so it is read from disk next time. If writing the file fails,
+// e.g. with ErrDiskFull, the key is dropped from the cache as well, so the cache never holds a value the disk lacks.
+func (d *MapDriver) Set(k string, v []byte) error {
+	d.drain()
+	if err := d.doc.Set(k, v); err != nil {
+		d.lru.Del(k)
+		return d.disk(err)
+	}
+	if err := d.lru.Set(k, append([]byte{}, v...)); err != nil {
+		d.lru.Del(k)
+	}
+	d.publish(k)
+	return nil
+}
+
+// Del removes the file first and the cache second. The key is dropped from the cache even if removing the file fails.
+func (d *MapDriver) Del(k string) error {
+	d.drain()
+	err := d.doc.Del(k)
+	d.lru.Del(k)
+	if err != nil {
+		return d.disk(err)
+	}
+	d.publish(k)
+	return nil
+}
+
+// ModTime returns the modification time of the file of k.
+func (d *MapDriver) ModTime(k string) (time.Time, error) {
+	return d.doc.ModTime(k)
+}
+
+func (d *MapDriver) MaxKeyLen() int {
+	return d.doc.MaxKeyLen()
+}
+
+func (d *MapDriver) Keys() ([]string, error) {
+	return d.doc.Keys()
+}
+
+// GetTo writes the value from the cache if it is cached, otherwise it streams the file and leaves the cache untouched.
+func (d *MapDriver) GetTo(k string, w io.Writer) (int64, error) {
+	d.drain()
+	if v, err := d.lru.Get(k); err == nil {
+		atomic.AddUint64(&d.hits, 1)
+		n, err := w.Write(v)
+		return int64(n), err
+	}
+	atomic.AddUint64(&d.misses, 1)
+	n, err := d.doc.GetTo(k, w)
+	return n, d.disk(err)
+}
+
+// Open returns the cached value if it is cached, otherwise it opens the file and leaves the cache untouched.
+func (d *MapDriver) Open(k string) (io.ReadSeekCloser, error) {
+	d.drain()
+	if v, err := d.lru.Get(k); err == nil {
+		atomic.AddUint64(&d.hits, 1)
+		return bytesReader{bytes.NewReader(v)}, nil
+	}
+	atomic.AddUint64(&d.misses, 1)
+	f, err := d.doc.Open(k)
+	return f, d.disk(err)
+}
+
+// GetDirect reads the value from disk even if it is cached, and refreshes the cache with it.
+func (d *MapDriver) GetDirect(k string) ([]byte, error) {
+	d.drain()
+	atomic.AddUint64(&d.misses, 1)
+	buf, err := d.doc.Get(k)
+	if errors.Is(err, os.ErrNotExist) {
+		d.lru.Del(k)
+	}
+	if err != nil {
+		return nil, d.disk(err)
+	}
+	if d.populate {
+		d.lru.Set(k, append([]byte{}, buf...))
+	} else {
+		d.lru.Del(k)
+	}
+	return buf, nil
+}
+
+// Invalidate drops k from the cache before the next operation and keeps the file, so the next Get reads the value from
+// disk again. Use it when the file is known to have been changed by others. It is safe to call concurrently with other
+// operations.
+func (d *MapDriver) Invalidate(k string) error {
+	d.invalidate(k)
+	return nil
+}
+
+// Warm loads the given keys from disk into the cache. Keys which do not exist are skipped. It fills the cache like a
+// Get does, so if the driver is shared through an Emerge call it with Emerge.Do.
+func (d *MapDriver) Warm(keys []string) error {
+	d.drain()
+	for _, k := range keys {
+		v, err := d.doc.Get(k)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return d.disk(err)
+		}
+		if err := d.lru.Set(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WarmAll fills the cache with the most recently modified files, as many as the cache holds. Like Warm, call it with
+// Emerge.Do if the driver is shared.
+func (d *MapDriver) WarmAll() error {
+	type file struct {
+		k string
+		t time.Time
+	}
+	l := []file{}
+	err := filepath.Walk(d.doc.root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(d.doc.root, p)
+		if err != nil {
+			return err
+		}
+		l = append(l, file{filepath.ToSlash(rel), info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return d.disk(err)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].t.After(l[j].t) })
+	if len(l) > d.size {
+		l = l[:d.size]
+	}
+	keys := make([]string, len(l))
+	for i, e := range l {
+		keys[len(l)-1-i] = e.k
+	}
+	return d.Warm(keys)
+}
+
+// CacheStats is a snapshot of the counters of MapDriver. Hits and Misses count lookups served by the LRU and lookups
+// falling back to the disk, Errors counts disk operations failed with an error other than ErrNotExist.
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+	Errors uint64
+}
+
+// CacheStats returns the counters of MapDriver. It is safe to call concurrently with other operations.
+func (d *MapDriver) CacheStats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadUint64(&d.hits),
+		Misses: atomic.LoadUint64(&d.misses),
+		Errors: atomic.LoadUint64(&d.errors),
+	}
+}
+
+// VersionedDriver keeps the last depth versions of every value, so a value can be rolled back. Previous versions are
+// stored in the inner driver under the key suffixed with "~n", where n is 1 for the most recent previous version.
+type VersionedDriver struct {
+	driver Driver
+	depth  int
+}
+
+// NewVersionedDriver returns a VersionedDriver.
+func NewVersionedDriver(driver Driver, depth int) *VersionedDriver {
+	return &VersionedDriver{
+		driver: driver,
+		depth:  depth,
+	}
+}
+
+func (d *VersionedDriver) key(k string, n int) string {
+	if n == 0 {
+		return k
+	}
+	return k + "~" + strconv.Itoa(n)
+}
+
+func (d *VersionedDriver) Get(k string) ([]byte, error) {
+	return d.driver.Get(k)
+}
+
+func (d *VersionedDriver) Set(k string, v []byte) error {
+	for n := d.depth; n > 0; n-- {
+		b, err := d.driver.Get(d.key(k, n-1))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := d.driver.Set(d.key(k, n), b); err != nil {
+			return err
+		}
+	}
+	return d.driver.Set(k, v)
+}
+
+func (d *VersionedDriver) Del(k string) error {
+	for n := 1; n <= d.depth; n++ {
+		if err := d.driver.Del(d.key(k, n)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return d.driver.Del(k)
+}
+
+// GetVersion returns the n-th previous version of the value, n = 0 means the current value. If the version does not
+// exist, ErrNotExist will be returned. It reads the inner driver, so if the driver is shared through an Emerge call it
+// with Emerge.Do.
+func (d *VersionedDriver) GetVersion(k string, n int) ([]byte, error) {
+	if n < 0 || n > d.depth {
+		return nil, os.ErrNotExist
+	}
+	return d.driver.Get(d.key(k, n))
+}
+
+// Rollback replaces the current value with the most recent previous version. If there is no previous version,
+// ErrNotExist will be returned. Like GetVersion, call it with Emerge.Do if the driver is shared.
+func (d *VersionedDriver) Rollback(k string) error {
+	if _, err := d.driver.Get(d.key(k, 1)); err != nil {
+		return err
+	}
+	for n := 0; n < d.depth; n++ {
+		b, err := d.driver.Get(d.key(k, n+1))
+		if errors.Is(err, os.ErrNotExist) {
+			if err := d.driver.Del(d.key(k, n)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := d.driver.Set(d.key(k, n), b); err != nil {
+			return err
+		}
+	}
+	if err := d.driver.Del(d.key(k, d.depth)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// NegativeCacheDriver remembers for ttl that a key does not exist in the inner driver, so repeated lookups of a missing
+// key do not hit a slow backend. A Set of the key forgets the miss at once. At most size misses are remembered, the
+// least recently found one is forgotten first, so looking up many distinct missing keys does not grow it without bound.
+type NegativeCacheDriver struct {
+	driver Driver
+	miss   *LruDriver
+	ttl    time.Duration
+}
+
+// NewNegativeCacheDriver returns a NegativeCacheDriver. The size must be positive, a size of 0 would remember no miss
+// at all.
+func NewNegativeCacheDriver(driver Driver, ttl time.Duration, size int) (*NegativeCacheDriver, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("acdb: invalid negative cache size %d", size)
+	}
+	return &NegativeCacheDriver{
+		driver: driver,
+		miss:   NewLruDriver(size),
+		ttl:    ttl,
+	}, nil
+}
+
+func (d *NegativeCacheDriver) Get(k string) ([]byte, error) {
+	// A miss is an empty entry, the time it was set tells when it expires.
+	if t, err := d.miss.ModTime(k); err == nil {
+		if time.Since(t) < d.ttl {
+			return nil, os.ErrNotExist
+		}
+		d.miss.Del(k)
+	}
+	v, err := d.driver.Get(k)
+	if errors.Is(err, os.ErrNotExist) {
+		d.miss.Set(k, nil)
+	}
+	return v, err
+}
+
+func (d *NegativeCacheDriver) Set(k string, v []byte) error {
+	d.miss.Del(k)
+	return d.driver.Set(k, v)
+}
+
+func (d *NegativeCacheDriver) Del(k string) error {
+	d.miss.Del(k)
+	return d.driver.Del(k)
+}
+
+// PromotingDriver keeps every key in the slow tier and copies the hot ones to the fast tier. Keys are copied up once
+// they have been read promote times, and are read from the fast tier from then on. The fast tier holds at most size
+// keys, when it is full the key with the fewest reads is dropped from it and its count is reset. Writes go to the slow
+// tier first, so the slow tier always holds every value and a volatile fast tier loses nothing, e.g. on a restart. It
+// suits skewed workloads where a few keys take most of the reads.
+//
+// Read counts are kept for at most 16 times size keys. Beyond that all counts are halved and keys whose count drops to
+// zero are forgotten, so the counts are bounded and favor recent reads.
+type PromotingDriver struct {
+	fast    Driver
+	slow    Driver
+	count   map[string]int
+	hot     map[string]struct{}
+	promote int
+	size    int
+}
+
+// NewPromotingDriver returns a PromotingDriver.
+func NewPromotingDriver(fast Driver, slow Driver, promote int, size int) *PromotingDriver {
+	return &PromotingDriver{
+		fast:    fast,
+		slow:    slow,
+		count:   map[string]int{},
+		hot:     map[string]struct{}{},
+		promote: promote,
+		size:    size,
+	}
+}
+
+// drop removes k from the fast tier. The slow tier still holds it.
+func (d *PromotingDriver) drop(k string) {
+	d.fast.Del(k)
+	delete(d.hot, k)
+	delete(d.count, k)
+}
+
+// decay halves all counts until at most 16 times size keys are counted.
+func (d *PromotingDriver) decay() {
+	for len(d.count) > 16*d.size {
+		for k, n := range d.count {
+			if n/2 == 0 {
+				delete(d.count, k)
+			} else {
+				d.count[k] = n / 2
+			}
+		}
+	}
+}
+
+func (d *PromotingDriver) Get(k string) ([]byte, error) {
+	if _, b := d.hot[k]; b {
+		d.count[k]++
+		v, err := d.fast.Get(k)
+		if err == nil {
+			return v, nil
+		}
+		// The fast tier lost the copy, read the slow tier and count anew.
+		d.drop(k)
+	}
+	v, err := d.slow.Get(k)
+	if err != nil || d.size <= 0 {
+		return v, err
+	}
+	d.count[k]++
+	if d.count[k] < d.promote {
+		d.decay()
+		return v, nil
+	}
+	if len(d.hot) >= d.size {
+		c := ""
+		for h := range d.hot {
+			if c == "" || d.count[h] < d.count[c] {
+				c = h
+			}
+		}
+		d.drop(c)
+	}
+	// Failing to copy the value up only costs the next read a trip to the slow tier.
+	if d.fast.Set(k, v) == nil {
+		d.hot[k] = struct{}{}
+	}
+	return v, nil
+}
+
+func (d *PromotingDriver) Set(k string, v []byte) error {
+	if err := d.slow.Set(k, v); err != nil {
+		return err
+	}
+	if _, b := d.hot[k]; b && d.fast.Set(k, v) != nil {
+		d.drop(k)
+	}
+	return nil
+}
+
+func (d *PromotingDriver) Del(k string) error {
+	if _, b := d.hot[k]; b {
+		d.drop(k)
+	}
+	delete(d.count, k)
+	return d.slow.Del(k)
+}
+
+// DedupeDriver stores each distinct value once. The value is kept in the inner driver under "~blob/" followed by the
+// hex encoded sha256 of the value, the key itself only holds the hash. A reference count under "~refs/" followed by the
+// hash tracks how many keys share the value, and the value is removed when the last of them is deleted or overwritten.
+type DedupeDriver struct {
+	driver Driver
+}
+
+// NewDedupeDriver returns a DedupeDriver.
+func NewDedupeDriver(driver Driver) *DedupeDriver {
+	return &DedupeDriver{
+		driver: driver,
+	}
+}
+
+func (d *DedupeDriver) refs(h string) (int, error) {
+	b, err := d.driver.Get("~refs/" + h)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(b))
+}
+
+func (d *DedupeDriver) incr(h string, v []byte) error {
+	n, err := d.refs(h)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		if err := d.driver.Set("~blob/"+h, v); err != nil {
+			return err
+		}
+	}
+	return d.driver.Set("~refs/"+h, []byte(strconv.Itoa(n+1)))
+}
+
+func (d *DedupeDriver) decr(h string) error {
+	n, err := d.refs(h)
+	if err != nil {
+		return err
+	}
+	if n > 1 {
+		return d.driver.Set("~refs/"+h, []byte(strconv.Itoa(n-1)))
+	}
+	if err := d.driver.Del("~blob/" + h); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := d.driver.Del("~refs/" + h); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (d *DedupeDriver) Get(k string) ([]byte, error) {
+	h, err := d.driver.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	return d.driver.Get("~blob/" + string(h))
+}
+
+func (d *DedupeDriver) Set(k string, v []byte) error {
+	s := sha256.Sum256(v)
+	h := hex.EncodeToString(s[:])
+	old, err := d.driver.Get(k)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil && string(old) == h {
+		return nil
+	}
+	if err := d.incr(h, v); err != nil {
+		return err
+	}
+	if err := d.driver.Set(k, []byte(h)); err != nil {
+		return err
+	}
+	if old != nil {
+		return d.decr(string(old))
+	}
+	return nil
+}
+
+func (d *DedupeDriver) Del(k string) error {
+	h, err := d.driver.Get(k)
+	if err != nil {
+		return err
+	}
+	if err := d.driver.Del(k); err != nil {
+		return err
+	}
+	return d.decr(string(h))
+}
+
+// TimeoutDriver bounds the duration of every operation of the inner driver. Since drivers do not take a context, each
+// operation runs in its own goroutine; when it does not finish in time ErrTimeout is returned and the goroutine is
+// abandoned, it keeps running until the inner driver returns. So a hanging backend leaks goroutines, and the inner
+// driver must be safe for concurrent use, which is usually true for remote drivers but not for MemDriver or LruDriver.
+type TimeoutDriver struct {
+	driver  Driver
+	timeout time.Duration
+}
+
+// NewTimeoutDriver returns a TimeoutDriver.
+func NewTimeoutDriver(driver Driver, timeout time.Duration) *TimeoutDriver {
+	return &TimeoutDriver{
+		driver:  driver,
+		timeout: timeout,
+	}
+}
+
+func (d *TimeoutDriver) call(f func() ([]byte, error)) ([]byte, error) {
+	type result struct {
+		v   []byte
+		err error
+	}
+	c := make(chan result, 1)
+	go func() {
+		v, err := f()
+		c <- result{v, err}
+	}()
+	t := time.NewTimer(d.timeout)
+	defer t.Stop()
+	select {
+	case r := <-c:
+		return r.v, r.err
+	case <-t.C:
+		return nil, ErrTimeout
+	}
+}
+
+func (d *TimeoutDriver) Get(k string) ([]byte, error) {
+	return d.call(func() ([]byte, error) { return d.driver.Get(k) })
+}
+
+func (d *TimeoutDriver) Set(k string, v []byte) error {
+	_, err := d.call(func() ([]byte, error) { return nil, d.driver.Set(k, v) })
+	return err
+}
+
+func (d *TimeoutDriver) Del(k string) error {
+	_, err := d.call(func() ([]byte, error) { return nil, d.driver.Del(k) })
+	return err
+}
+
+// IndexDriver maintains an inverted index on top level fields of json values, so keys can be found by the value of a
+// field without scanning the store. String fields are indexed by their content, other fields by their json encoding,
+// e.g. "42" or "true". Values which are not json objects are stored but not indexed. The index lives in memory, it is
+// built from the inner driver on creation if it is a Lister, and kept up to date on Set and Del.
+type IndexDriver struct {
+	driver Driver
+	fields []string
+	index  map[string]map[string]map[string]struct{}
+	values map[string]map[string]string
+	m      sync.RWMutex
+}
+
+// NewIndexDriver returns a IndexDriver indexing the given fields.
+func NewIndexDriver(driver Driver, fields ...string) (*IndexDriver, error) {
+	d := &IndexDriver{
+		driver: driver,
+		fields: fields,
+		index:  map[string]map[string]map[string]struct{}{},
+		values: map[string]map[string]string{},
+	}
+	for _, f := range fields {
+		d.index[f] = map[string]map[string]struct{}{}
+	}
+	if l, ok := driver.(Lister); ok {
+		keys, err := l.Keys()
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range keys {
+			v, err := driver.Get(k)
+			if err != nil {
+				return nil, err
+			}
+			d.add(k, v)
+		}
+	}
+	return d, nil
+}
+
+func (d *IndexDriver) add(k string, v []byte) {
+	o := map[string]json.RawMessage{}
+	if json.Unmarshal(v, &o) != nil {
+		return
+	}
+	m := map[string]string{}
+	for _, f := range d.fields {
+		r, b := o[f]
+		if !b {
+			continue
+		}
+		s := string(r)
+		var e string
+		if json.Unmarshal(r, &e) == nil {
+			s = e
+		}
+		m[f] = s
+		if d.index[f][s] == nil {
+			d.index[f][s] = map[string]struct{}{}
+		}
+		d.index[f][s][k] = struct{}{}
+	}
+	d.values[k] = m
+}
+
+func (d *IndexDriver) remove(k string) {
+	for f, s := range d.values[k] {
+		delete(d.index[f][s], k)
+		if len(d.index[f][s]) == 0 {
+			delete(d.index[f], s)
+		}
+	}
+	delete(d.values, k)
+}
+
+func (d *IndexDriver) Get(k string) ([]byte, error) {
+	return d.driver.Get(k)
+}
+
+func (d *IndexDriver) Set(k string, v []byte) error {
+	if err := d.driver.Set(k, v); err != nil {
+		return err
+	}
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.remove(k)
+	d.add(k, v)
+	return nil
+}
+
+func (d *IndexDriver) Del(k string) error {
+	if err := d.driver.Del(k); err != nil {
+		return err
+	}
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.remove(k)
+	return nil
+}
+
+// FindBy returns the keys whose value has the field set to value, in no particular order. If the field is not indexed,
+// ErrUnsupported will be returned. It is safe to call concurrently with other operations.
+func (d *IndexDriver) FindBy(field string, value string) ([]string, error) {
+	d.m.RLock()
+	defer d.m.RUnlock()
+	m, b := d.index[field]
+	if !b {
+		return nil, ErrUnsupported
+	}
+	r := make([]string, 0, len(m[value]))
+	for k := range m[value] {
+		r = append(r, k)
+	}
+	return r, nil
+}
+
+// SchemaDriver rejects keys not matching a pattern with ErrInvalidKey, so a malformed key fails loudly instead of
+// silently creating or missing an entry. Set and Del are always checked, Get only if reads is true.
+type SchemaDriver struct {
+	driver  Driver
+	pattern *regexp.Regexp
+	reads   bool
+}
+
+// NewSchemaDriver returns a SchemaDriver.
+func NewSchemaDriver(driver Driver, pattern *regexp.Regexp, reads bool) *SchemaDriver {
+	return &SchemaDriver{
+		driver:  driver,
+		pattern: pattern,
+		reads:   reads,
+	}
+}
+
+func (d *SchemaDriver) Get(k string) ([]byte, error) {
+	if d.reads && !d.pattern.MatchString(k) {
+		return nil, ErrInvalidKey
+	}
+	return d.driver.Get(k)
+}
+
+func (d *SchemaDriver) Set(k string, v []byte) error {
+	if !d.pattern.MatchString(k) {
+		return ErrInvalidKey
+	}
+	return d.driver.Set(k, v)
+}
+
+func (d *SchemaDriver) Del(k string) error {
+	if !d.pattern.MatchString(k) {
+		return ErrInvalidKey
+	}
+	return d.driver.Del(k)
+}
+
+// ValidateDriver checks every value on Set with validate, and rejects it with an error matching ErrSchemaViolation if
+// validate fails, so malformed values are never stored. Gets and Dels pass through. validate is usually the Validate
+// method of a compiled JSON Schema from a schema library, decoding the value first.
+type ValidateDriver struct {
+	driver   Driver
+	validate func(k string, v []byte) error
+}
+
+// NewValidateDriver returns a ValidateDriver.
+func NewValidateDriver(driver Driver, validate func(k string, v []byte) error) *ValidateDriver {
+	return &ValidateDriver{
+		driver:   driver,
+		validate: validate,
+	}
+}
+
+func (d *ValidateDriver) Get(k string) ([]byte, error) {
+	return d.driver.Get(k)
+}
+
+func (d *ValidateDriver) Set(k string, v []byte) error {
+	if err := d.validate(k, v); err != nil {
+		return &schemaError{err}
+	}
+	return d.driver.Set(k, v)
+}
+
+func (d *ValidateDriver) Del(k string) error {
+	return d.driver.Del(k)
+}
+
+// CountDriver counts the successful Gets of every key, so the hottest keys can be found. The count of a key is reset
+// when it is deleted. Counting costs a map update per Get, so it is a separate driver rather than a feature of others.
+type CountDriver struct {
+	driver Driver
+	count  map[string]uint64
+	m      sync.Mutex
+}
+
+// NewCountDriver returns a CountDriver.
+func NewCountDriver(driver Driver) *CountDriver {
+	return &CountDriver{
+		driver: driver,
+		count:  map[string]uint64{},
+	}
+}
+
+func (d *CountDriver) Get(k string) ([]byte, error) {
+	v, err := d.driver.Get(k)
+	if err == nil {
+		d.m.Lock()
+		d.count[k]++
+		d.m.Unlock()
+	}
+	return v, err
+}
+
+func (d *CountDriver) Set(k string, v []byte) error {
+	return d.driver.Set(k, v)
+}
+
+func (d *CountDriver) Del(k string) error {
+	d.m.Lock()
+	delete(d.count, k)
+	d.m.Unlock()
+	return d.driver.Del(k)
+}
+
+// AccessCount returns the number of successful Gets of k since it was last deleted. It is safe to call concurrently
+// with other operations.
+func (d *CountDriver) AccessCount(k string) (uint64, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.count[k], nil
+}
+
+// LatencyDriver records the latency of every operation of a driver in a histogram per operation, so tail latencies,
+// e.g. of a slow disk under DocDriver, can be told from the average. Recording is lock-free: the histogram has
+// logarithmic buckets with 8 linear sub buckets each, so a percentile is accurate to 1/8 of its magnitude, and a
+// record is a single atomic increment.
+type LatencyDriver struct {
+	driver Driver
+	get    latencyHistogram
+	set    latencyHistogram
+	del    latencyHistogram
+}
+
+// latencyHistogram counts durations in nanoseconds. Bucket i*8+j holds durations whose highest bit is bit i and whose
+// next 3 bits are j.
+type latencyHistogram [64 * 8]uint64
+
+func (h *latencyHistogram) record(d time.Duration) {
+	n := uint64(d)
+	if d < 0 {
+		n = 0
+	}
+	i := bits.Len64(n)
+	j := uint64(0)
+	if i > 3 {
+		j = n >> (i - 4) & 7
+	} else {
+		j = n & 7
+		i = 0
+	}
+	atomic.AddUint64(&h[i*8+int(j)], 1)
+}
+
+// latencyPercentile returns the upper bound of the bucket of c holding the p-th percentile, p in (0, 1].
+func latencyPercentile(c *latencyHistogram, total uint64, p float64) time.Duration {
+	want := uint64(math.Ceil(float64(total) * p))
+	n := uint64(0)
+	for b, e := range c {
+		n += e
+		if n < want || n == 0 {
+			continue
+		}
+		i, j := b/8, uint64(b%8)
+		if i == 0 {
+			return time.Duration(j)
+		}
+		return time.Duration((8+j+1)<<(i-4) - 1)
+	}
+	return 0
+}
+
+func (h *latencyHistogram) report() Latency {
+	var c latencyHistogram
+	total := uint64(0)
+	for i := range h {
+		c[i] = atomic.LoadUint64(&h[i])
+		total += c[i]
+	}
+	return Latency{
+		Count: total,
+		P50:   latencyPercentile(&c, total, 0.50),
+		P95:   latencyPercentile(&c, total, 0.95),
+		P99:   latencyPercentile(&c, total, 0.99),
+	}
+}
+
+// Latency holds the number of operations recorded and the percentiles of their latency.
+type Latency struct {
+	Count uint64
+	P50   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+}
+
+// LatencyReport holds the latency of each operation.
+type LatencyReport struct {
+	Get Latency
+	Set Latency
+	Del Latency
+}
+
+// NewLatencyDriver returns a LatencyDriver.
+func NewLatencyDriver(driver Driver) *LatencyDriver {
+	return &LatencyDriver{driver: driver}
+}
+
+func (d *LatencyDriver) Get(k string) ([]byte, error) {
+	t := time.Now()
+	v, err := d.driver.Get(k)
+	d.get.record(time.Since(t))
+	return v, err
+}
+
+func (d *LatencyDriver) Set(k string, v []byte) error {
+	t := time.Now()
+	err := d.driver.Set(k, v)
+	d.set.record(time.Since(t))
+	return err
+}
+
+func (d *LatencyDriver) Del(k string) error {
+	t := time.Now()
+	err := d.driver.Del(k)
+	d.del.record(time.Since(t))
+	return err
+}
+
+// Latencies returns the latency percentiles of all operations since the driver was created, failed ones included. It
+// is safe to call concurrently with the operations.
+func (d *LatencyDriver) Latencies() LatencyReport {
+	return LatencyReport{
+		Get: d.get.report(),
+		Set: d.set.report(),
+		Del: d.del.report(),
+	}
+}
+
+// ChunkDriver splits values into chunks of at most size bytes, so values larger than the item limit of a backend can be
+// stored. The key itself holds a manifest of the number of chunks and their generation. The chunks are stored under
+// the key suffixed with "~c", the generation and the chunk index. A Set writes the chunks of a new generation first,
+// then commits the manifest and deletes the old generation, so a failed Set leaves the old value readable.
+type ChunkDriver struct {
+	driver Driver
+	size   int
+}
+
+// NewChunkDriver returns a ChunkDriver. The size must be positive.
+func NewChunkDriver(driver Driver, size int) (*ChunkDriver, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("acdb: invalid chunk size %d", size)
+	}
+	return &ChunkDriver{
+		driver: driver,
+		size:   size,
+	}, nil
+}
+
+// key returns the key of the i-th chunk of generation g. Generation 0 keeps the keys of a manifest without generation.
+func (d *ChunkDriver) key(k string, g int, i int) string {
+	if g == 0 {
+		return k + "~c" + strconv.Itoa(i)
+	}
+	return k + "~c" + strconv.Itoa(g) + "." + strconv.Itoa(i)
+}
+
+// chunks returns the number of chunks of k and their generation.
+func (d *ChunkDriver) chunks(k string) (int, int, error) {
+	b, err := d.driver.Get(k)
+	if err != nil {
+		return 0, 0, err
+	}
+	n, g, ok := strings.Cut(string(b), " ")
+	if !ok {
+		g = "0"
+	}
+	c, err := strconv.Atoi(n)
+	if err != nil {
+		return 0, 0, err
+	}
+	r, err := strconv.Atoi(g)
+	if err != nil {
+		return 0, 0, err
+	}
+	return c, r, nil
+}
+
+// prune deletes the chunks of generation g of k from i to n.
+func (d *ChunkDriver) prune(k string, g int, i int, n int) error {
+	for ; i < n; i++ {
+		if err := d.driver.Del(d.key(k, g, i)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *ChunkDriver) Get(k string) ([]byte, error) {
+	n, g, err := d.chunks(k)
+	if err != nil {
+		return nil, err
+	}
+	r := []byte{}
+	for i := 0; i < n; i++ {
+		b, err := d.driver.Get(d.key(k, g, i))
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, b...)
+	}
+	return r, nil
+}
+
+func (d *ChunkDriver) Set(k string, v []byte) error {
+	m, g, err := d.chunks(k)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	h := 0
+	if err == nil {
+		h = g + 1
+	}
+	n := 0
+	for ; len(v) > 0; n++ {
+		c := v
+		if len(c) > d.size {
+			c = c[:d.size]
+		}
+		if err := d.driver.Set(d.key(k, h, n), c); err != nil {
+			// The manifest still points to the old generation, the chunks written so far are left over.
+			d.prune(k, h, 0, n)
+			return err
+		}
+		v = v[len(c):]
+	}
+	if err := d.driver.Set(k, []byte(strconv.Itoa(n)+" "+strconv.Itoa(h))); err != nil {
+		d.prune(k, h, 0, n)
+		return err
+	}
+	return d.prune(k, g, 0, m)
+}
+
+func (d *ChunkDriver) Del(k string) error {
+	n, g, err := d.chunks(k)
+	if err != nil {
+		return err
+	}
+	if err := d.driver.Del(k); err != nil {
+		return err
+	}
+	return d.prune(k, g, 0, n)
+}
+
+// BloomDriver keeps a bloom filter of the keys of the inner driver, so a Get of a key which was never set returns
+// ErrNotExist without touching the inner driver. A false positive costs only an unnecessary lookup. Deleted keys stay
+// in the filter, since a bloom filter can not forget, until the driver is created again. The filter is built from the
+// keys of the inner driver on creation, so the inner driver must be a Lister.
+type BloomDriver struct {
+	driver Driver
+	bits   []uint64
+	hashes int
+}
+
+// NewBloomDriver returns a BloomDriver sized for n keys with a false positive rate of p.
+func NewBloomDriver(driver Driver, n int, p float64) (*BloomDriver, error) {
+	l, ok := driver.(Lister)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	if n < 1 {
+		n = 1
+	}
+	m := int(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := int(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	d := &BloomDriver{
+		driver: driver,
+		bits:   make([]uint64, (m+63)/64),
+		hashes: k,
+	}
+	keys, err := l.Keys()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range keys {
+		d.add(e)
+	}
+	return d, nil
+}
+
+// locate returns the two base hashes of k, the i-th bit of k is h1 + i * h2.
+func (d *BloomDriver) locate(k string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(k))
+	s := h.Sum64()
+	return s, s>>32 | 1
+}
+
+func (d *BloomDriver) add(k string) {
+	h1, h2 := d.locate(k)
+	m := uint64(len(d.bits) * 64)
+	for i := 0; i < d.hashes; i++ {
+		b := (h1 + uint64(i)*h2) % m
+		d.bits[b/64] |= 1 << (b % 64)
+	}
+}
+
+func (d *BloomDriver) has(k string) bool {
+	h1, h2 := d.locate(k)
+	m := uint64(len(d.bits) * 64)
+	for i := 0; i < d.hashes; i++ {
+		b := (h1 + uint64(i)*h2) % m
+		if d.bits[b/64]&(1<<(b%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *BloomDriver) Get(k string) ([]byte, error) {
+	if !d.has(k) {
+		return nil, os.ErrNotExist
+	}
+	return d.driver.Get(k)
+}
+
+func (d *BloomDriver) Set(k string, v []byte) error {
+	d.add(k)
+	return d.driver.Set(k, v)
+}
+
+func (d *BloomDriver) Del(k string) error {
+	return d.driver.Del(k)
+}
+
+// DefaultsDriver returns a registered default value when the inner driver does not have the key. Defaults are never
+// written to the inner driver, so a deleted key falls back to its default again.
+type DefaultsDriver struct {
+	driver   Driver
+	defaults map[string][]byte
+}
+
+// NewDefaultsDriver returns a DefaultsDriver.
+func NewDefaultsDriver(driver Driver, defaults map[string][]byte) *DefaultsDriver {
+	return &DefaultsDriver{
+		driver:   driver,
+		defaults: defaults,
+	}
+}
+
+func (d *DefaultsDriver) Get(k string) ([]byte, error) {
+	v, err := d.driver.Get(k)
+	if errors.Is(err, os.ErrNotExist) {
+		if v, b := d.defaults[k]; b {
+			return v, nil
+		}
+	}
+	return v, err
+}
+
+func (d *DefaultsDriver) Set(k string, v []byte) error {
+	return d.driver.Set(k, v)
+}
+
+func (d *DefaultsDriver) Del(k string) error {
+	return d.driver.Del(k)
+}
+
+// LoadingDriver calls a loader when the inner driver does not have the key, stores the loaded value in the inner driver
+// and returns it, so the inner driver acts as a cache in front of any data source. Errors of the loader are returned as
+// is, a loader should return ErrNotExist for keys which do not exist in the data source either.
+type LoadingDriver struct {
+	driver Driver
+	loader func(k string) ([]byte, error)
+}
+
+// NewLoadingDriver returns a LoadingDriver.
+func NewLoadingDriver(driver Driver, loader func(k string) ([]byte, error)) *LoadingDriver {
+	return &LoadingDriver{
+		driver: driver,
+		loader: loader,
+	}
+}
+
+func (d *LoadingDriver) Get(k string) ([]byte, error) {
+	v, err := d.driver.Get(k)
+	if !errors.Is(err, os.ErrNotExist) {
+		return v, err
+	}
+	v, err = d.loader(k)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.driver.Set(k, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (d *LoadingDriver) Set(k string, v []byte) error {
+	return d.driver.Set(k, v)
+}
+
+func (d *LoadingDriver) Del(k string) error {
+	return d.driver.Del(k)
+}
+
+// AesDriver encrypts values with AES-GCM before they reach the inner driver. Optionally keys are encrypted too, so that
+// for example the file names of a DocDriver reveal nothing. Keys are encrypted deterministically, in the manner of
+// AES-SIV: the IV is a HMAC-SHA256 of the key, the key is encrypted with AES-CTR under that IV, and the name stored in
+// the inner driver is the unpadded base64url encoding of IV and ciphertext. So the same key always maps to the same
+// name, and Keys can decrypt names back to keys.
+type AesDriver struct {
+	driver Driver
+	aead   cipher.AEAD
+	block  cipher.Block
+	mac    []byte
+	keys   bool
+}
+
+// NewAesDriver returns a AesDriver. The secret must be 16, 24 or 32 bytes long to select AES-128, AES-192 or AES-256.
+func NewAesDriver(driver Driver, secret []byte, keys bool) (*AesDriver, error) {
+	if _, err := aes.NewCipher(secret); err != nil {
+		return nil, err
+	}
+	derive := func(label string) []byte {
+		h := hmac.New(sha256.New, secret)
+		h.Write([]byte(label))
+		return h.Sum(nil)[:len(secret)]
+	}
+	b, err := aes.NewCipher(derive("acdb value"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(b)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(derive("acdb key"))
+	if err != nil {
+		return nil, err
+	}
+	return &AesDriver{
+		driver: driver,
+		aead:   aead,
+		block:  block,
+		mac:    derive("acdb mac"),
+		keys:   keys,
+	}, nil
+}
+
+// name returns the name of k in the inner driver.
+func (d *AesDriver) name(k string) string {
+	if !d.keys {
+		return k
+	}
+	h := hmac.New(sha256.New, d.mac)
+	h.Write([]byte(k))
+	iv := h.Sum(nil)[:aes.BlockSize]
+	r := make([]byte, aes.BlockSize+len(k))
+	copy(r, iv)
+	cipher.NewCTR(d.block, iv).XORKeyStream(r[aes.BlockSize:], []byte(k))
+	return base64.RawURLEncoding.EncodeToString(r)
+}
+
+// key returns the key of name n in the inner driver, or an error if n is not a name produced by the driver.
+func (d *AesDriver) key(n string) (string, error) {
+	if !d.keys {
+		return n, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil || len(b) < aes.BlockSize {
+		return "", ErrInvalidKey
+	}
+	k := make([]byte, len(b)-aes.BlockSize)
+	cipher.NewCTR(d.block, b[:aes.BlockSize]).XORKeyStream(k, b[aes.BlockSize:])
+	if d.name(string(k)) != n {
+		return "", ErrInvalidKey
+	}
+	return string(k), nil
+}
+
+func (d *AesDriver) Get(k string) ([]byte, error) {
+	b, err := d.driver.Get(d.name(k))
+	if err != nil {
+		return nil, err
+	}
+	n := d.aead.NonceSize()
+	if len(b) < n {
+		return nil, ErrCorrupt
+	}
+	v, err := d.aead.Open(nil, b[:n], b[n:], []byte(k))
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return v, nil
+}
+
+func (d *AesDriver) Set(k string, v []byte) error {
+	nonce := make([]byte, d.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	return d.driver.Set(d.name(k), d.aead.Seal(nonce, nonce, v, []byte(k)))
+}
+
+func (d *AesDriver) Del(k string) error {
+	return d.driver.Del(d.name(k))
+}
+
+// Keys returns the keys of the inner driver, decrypted if keys are encrypted. Names which were not produced by the
+// driver are skipped. If the inner driver is not a Lister, ErrUnsupported will be returned.
+func (d *AesDriver) Keys() ([]string, error) {
+	l, ok := d.driver.(Lister)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	names, err := l.Keys()
+	if err != nil {
+		return nil, err
+	}
+	r := make([]string, 0, len(names))
+	for _, n := range names {
+		if k, err := d.key(n); err == nil {
+			r = append(r, k)
+		}
+	}
+	return r, nil
+}
+
+// RollingCounter counts events in time buckets of a fixed granularity, and sums the buckets of a recent window. All
+// buckets of a name are stored together as a json object under the name in the driver, buckets older than retention
+// are dropped whenever the name is incremented. It is concurrency-safety as long as the driver is not used by others.
+type RollingCounter struct {
+	m           sync.Mutex
+	driver      Driver
+	granularity time.Duration
+	retention   time.Duration
+}
+
+// NewRollingCounter returns a RollingCounter. The granularity must be positive.
+func NewRollingCounter(driver Driver, granularity time.Duration, retention time.Duration) (*RollingCounter, error) {
+	if granularity <= 0 {
+		return nil, fmt.Errorf("acdb: invalid granularity %s", granularity)
+	}
+	return &RollingCounter{
+		driver:      driver,
+		granularity: granularity,
+		retention:   retention,
+	}, nil
+}
+
+func (c *RollingCounter) buckets(name string) (map[int64]uint64, error) {
+	r := map[int64]uint64{}
+	b, err := c.driver.Get(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, json.Unmarshal(b, &r)
+}
+
+// Incr increments the counter of the current bucket of name.
+func (c *RollingCounter) Incr(name string) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	r, err := c.buckets(name)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UnixNano() / int64(c.granularity)
+	for i := range r {
+		if i <= now-int64(c.retention/c.granularity) {
+			delete(r, i)
+		}
+	}
+	r[now]++
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return c.driver.Set(name, b)
+}
+
+// Sum returns the total of the buckets of name within the window, including the current bucket.
+func (c *RollingCounter) Sum(name string, window time.Duration) (uint64, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	r, err := c.buckets(name)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().UnixNano() / int64(c.granularity)
+	n := uint64(0)
+	for i, e := range r {
+		if i > now-int64(window/c.granularity) {
+			n += e
+		}
+	}
+	return n, nil
+}
+
+// List stores ordered lists of values with Redis-like list semantics. Each element is stored under the name of the
+// list suffixed with "~l" and a position, and the range of positions is stored as a json object under the name, so a
+// push writes one element and the range instead of the whole list. Lists longer than max are trimmed from the tail
+// on push, a max of 0 means no limit. It is concurrency-safety as long as the driver is not used by others.
+//
+// The keys of a list are the name itself and the name suffixed with "~l" and a number, and a list owns them all: a
+// user key of the same form, e.g. "queue~l3", would be overwritten or deleted by the list "queue". Give lists a driver
+// of their own, or a name space no other key uses.
+type List struct {
+	m      sync.Mutex
+	driver Driver
+	max    int
+}
+
+type listRange struct {
+	Head int64 `json:"head"`
+	Tail int64 `json:"tail"`
+}
+
+// NewList returns a List.
+func NewList(driver Driver, max int) *List {
+	return &List{
+		driver: driver,
+		max:    max,
+	}
+}
+
+func (l *List) bounds(name string) (listRange, error) {
+	r := listRange{}
+	b, err := l.driver.Get(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return r, err
+	}
+	return r, json.Unmarshal(b, &r)
+}
+
+func (l *List) elem(name string, i int64) string {
+	return name + "~l" + strconv.FormatInt(i, 10)
+}
+
+// LPush inserts v at the head of the list, and returns the length of the list after.
+func (l *List) LPush(name string, v []byte) (int, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	r, err := l.bounds(name)
+	if err != nil {
+		return 0, err
+	}
+	if err := l.driver.Set(l.elem(name, r.Head-1), v); err != nil {
+		return 0, err
+	}
+	r.Head--
+	var drop []int64
+	for l.max > 0 && r.Tail-r.Head > int64(l.max) {
+		r.Tail--
+		drop = append(drop, r.Tail)
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return 0, err
+	}
+	if err := l.driver.Set(name, b); err != nil {
+		return 0, err
+	}
+	for _, i := range drop {
+		if err := l.driver.Del(l.elem(name, i)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return 0, err
+		}
+	}
+	return int(r.Tail - r.Head), nil
+}
+
+// LPop removes and returns the element at the head of the list. If the list is empty, ErrNotExist will be returned.
+// The list is deleted once its last element is popped.
+func (l *List) LPop(name string) ([]byte, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	r, err := l.bounds(name)
+	if err != nil {
+		return nil, err
+	}
+	if r.Tail == r.Head {
+		return nil, os.ErrNotExist
+	}
+	v, err := l.driver.Get(l.elem(name, r.Head))
+	if err != nil {
+		return nil, err
+	}
+	r.Head++
+	if r.Tail == r.Head {
+		err = l.driver.Del(name)
+	} else {
+		var b []byte
+		if b, err = json.Marshal(r); err == nil {
+			err = l.driver.Set(name, b)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := l.driver.Del(l.elem(name, r.Head-1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Del deletes the list with all its elements. If the list does not exist, ErrNotExist will be returned.
+func (l *List) Del(name string) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	r, err := l.bounds(name)
+	if err != nil {
+		return err
+	}
+	if r.Tail == r.Head {
+		return os.ErrNotExist
+	}
+	// The range goes first, so a failure halfway leaves orphan elements rather than a list with holes.
+	if err := l.driver.Del(name); err != nil {
+		return err
+	}
+	for i := r.Head; i < r.Tail; i++ {
+		if err := l.driver.Del(l.elem(name, i)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// LLen returns the length of the list, 0 if it does not exist.
+func (l *List) LLen(name string) (int, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	r, err := l.bounds(name)
+	if err != nil {
+		return 0, err
+	}
+	return int(r.Tail - r.Head), nil
+}
+
+// LRange returns the elements from start to stop, both inclusive and counted from the head. Negative indexes count
+// from the tail, -1 is the last element. Indexes out of the list are clamped, so LRange(name, 0, -1) returns the whole
+// list.
+func (l *List) LRange(name string, start int, stop int) ([][]byte, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	r, err := l.bounds(name)
+	if err != nil {
+		return nil, err
+	}
+	n := int(r.Tail - r.Head)
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	var e [][]byte
+	for i := start; i <= stop; i++ {
+		v, err := l.driver.Get(l.elem(name, r.Head+int64(i)))
+		if err != nil {
+			return nil, err
+		}
+		e = append(e, v)
+	}
+	return e, nil
+}
+
+// ProtectDriver makes the keys accepted by protected read only, Set and Del of them return ErrReadOnly. Other keys and
+// all reads pass through, e.g. to keep a few configuration keys immutable in an otherwise writable store.
+type ProtectDriver struct {
+	driver    Driver
+	protected func(k string) bool
+}
+
+// NewProtectDriver returns a ProtectDriver.
+func NewProtectDriver(driver Driver, protected func(k string) bool) *ProtectDriver {
+	return &ProtectDriver{
+		driver:    driver,
+		protected: protected,
+	}
+}
+
+func (d *ProtectDriver) Get(k string) ([]byte, error) {
+	return d.driver.Get(k)
+}
+
+func (d *ProtectDriver) Set(k string, v []byte) error {
+	if d.protected(k) {
+		return ErrReadOnly
+	}
+	return d.driver.Set(k, v)
+}
+
+func (d *ProtectDriver) Del(k string) error {
+	if d.protected(k) {
+		return ErrReadOnly
+	}
+	return d.driver.Del(k)
+}
+
+// OverlayDriver layers a writable upper driver over a read only lower driver, copy-on-write. Reads check the upper
+// driver first and fall back to the lower one, writes only go to the upper driver. Deleting a key which exists in the
+// lower driver leaves a tombstone in the upper driver under the key suffixed with "~del", which masks the lower key.
+type OverlayDriver struct {
+	upper Driver
+	lower Driver
+}
+
+// NewOverlayDriver returns a OverlayDriver.
+func NewOverlayDriver(upper Driver, lower Driver) *OverlayDriver {
+	return &OverlayDriver{
+		upper: upper,
+		lower: lower,
+	}
+}
+
+func (d *OverlayDriver) Get(k string) ([]byte, error) {
+	v, err := d.upper.Get(k)
+	if !errors.Is(err, os.ErrNotExist) {
+		return v, err
+	}
+	_, err = d.upper.Get(k + "~del")
+	if err == nil {
+		return nil, os.ErrNotExist
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return d.lower.Get(k)
+}
+
+func (d *OverlayDriver) Set(k string, v []byte) error {
+	if err := d.upper.Set(k, v); err != nil {
+		return err
+	}
+	if err := d.upper.Del(k + "~del"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (d *OverlayDriver) Del(k string) error {
+	if _, err := d.Get(k); err != nil {
+		return err
+	}
+	if err := d.upper.Del(k); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	_, err := d.lower.Get(k)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return d.upper.Set(k+"~del", []byte{})
+}
+
+// MigrateDriver moves keys from an old driver to a new one as they are used, so a store can be migrated without
+// downtime. Get reads the new driver first and falls back to the old one, a value found there is copied forward: it is
+// written to the new driver and deleted from the old one. Writes only go to the new driver. MigrateAll completes the
+// migration of the keys never used. It is concurrency-safety by itself, so MigrateAll can run in the background.
+type MigrateDriver struct {
+	m   sync.Mutex
+	new Driver
+	old Driver
+}
+
+// NewMigrateDriver returns a MigrateDriver.
+func NewMigrateDriver(new Driver, old Driver) *MigrateDriver {
+	return &MigrateDriver{
+		new: new,
+		old: old,
+	}
+}
+
+func (d *MigrateDriver) Get(k string) ([]byte, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	v, err := d.new.Get(k)
+	if !errors.Is(err, os.ErrNotExist) {
+		return v, err
+	}
+	v, err = d.old.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.new.Set(k, v); err != nil {
+		return nil, err
+	}
+	if err := d.old.Del(k); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Set writes the new driver, and deletes the key from the old one so a stale value can not be migrated later.
+func (d *MigrateDriver) Set(k string, v []byte) error {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if err := d.new.Set(k, v); err != nil {
+		return err
+	}
+	if err := d.old.Del(k); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Del deletes the key from both drivers. If it exists in neither, ErrNotExist will be returned.
+func (d *MigrateDriver) Del(k string) error {
+	d.m.Lock()
+	defer d.m.Unlock()
+	a := d.new.Del(k)
+	if a != nil && !errors.Is(a, os.ErrNotExist) {
+		return a
+	}
+	b := d.old.Del(k)
+	if b != nil && !errors.Is(b, os.ErrNotExist) {
+		return b
+	}
+	if a != nil && b != nil {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// MigrateAll migrates every key left in the old driver, which must be a Lister, otherwise ErrUnsupported will be
+// returned. It stops at the first error, the keys migrated before stay migrated. Every key is migrated under its own
+// lock acquisition, so other operations proceed meanwhile.
+func (d *MigrateDriver) MigrateAll() error {
+	l, ok := d.old.(Lister)
+	if !ok {
+		return ErrUnsupported
+	}
+	d.m.Lock()
+	keys, err := l.Keys()
+	d.m.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if _, err := d.Get(k); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// HTTPDriver is a client of a cmd/acdb server, so a remote store can be used as a local driver, e.g. under a
+// MapDriver-like cache. Keys are sent as url paths with each segment escaped, a 404 Not Found maps to ErrNotExist.
+type HTTPDriver struct {
+	base   string
+	client *http.Client
+}
+
+// NewHTTPDriver returns a HTTPDriver. If client is nil, http.DefaultClient is used.
+func NewHTTPDriver(baseURL string, client *http.Client) *HTTPDriver {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPDriver{
+		base:   strings.TrimSuffix(baseURL, "/"),
+		client: client,
+	}
+}
+
+func (d *HTTPDriver) do(method string, k string, body []byte) ([]byte, error) {
+	l := strings.Split(k, "/")
+	for i, e := range l {
+		l[i] = url.PathEscape(e)
+	}
+	req, err := http.NewRequest(method, d.base+"/"+strings.Join(l, "/"), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	res, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound && method != http.MethodPut {
+		return nil, os.ErrNotExist
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("acdb: %s %s: %s: %s", method, k, res.Status, b)
+	}
+	return b, nil
+}
+
+func (d *HTTPDriver) Get(k string) ([]byte, error) {
+	return d.do(http.MethodGet, k, nil)
+}
+
+func (d *HTTPDriver) Set(k string, v []byte) error {
+	_, err := d.do(http.MethodPut, k, v)
+	return err
+}
+
+func (d *HTTPDriver) Del(k string) error {
+	_, err := d.do(http.MethodDelete, k, nil)
+	return err
+}
+
+func (d *HTTPDriver) Keys() ([]string, error) {
+	b, err := d.do(http.MethodGet, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	r := []string{}
+	for _, e := range strings.Split(string(b), "\n") {
+		if e == "" {
+			continue
+		}
+		k, err := url.PathUnescape(e)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, k)
+	}
+	return r, nil
+}
+
+// EtcdDriver stores keys in an etcd v3 cluster through its JSON gateway, so it needs no client library. Every key is
+// stored under prefix, a missing key maps to ErrNotExist. Requests go to the first endpoint which answers. Operations
+// use the context given to WithContext, which bounds or cancels them as etcd is remote.
+type EtcdDriver struct {
+	ctx       context.Context
+	endpoints []string
+	prefix    string
+	client    *http.Client
+}
+
+type etcdKv struct {
+	Key   []byte `json:"key,omitempty"`
+	Value []byte `json:"value,omitempty"`
+}
+
+type etcdRequest struct {
+	Key      []byte `json:"key"`
+	Value    []byte `json:"value,omitempty"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+	KeysOnly bool   `json:"keys_only,omitempty"`
+}
+
+type etcdResponse struct {
+	Kvs     []etcdKv `json:"kvs"`
+	Deleted string   `json:"deleted"`
+}
+
+// NewEtcdDriver returns a EtcdDriver, endpoints are urls like "http://127.0.0.1:2379".
+func NewEtcdDriver(endpoints []string, prefix string) *EtcdDriver {
+	l := make([]string, len(endpoints))
+	for i, e := range endpoints {
+		l[i] = strings.TrimSuffix(e, "/")
+	}
+	return &EtcdDriver{
+		ctx:       context.Background(),
+		endpoints: l,
+		prefix:    prefix,
+		client:    http.DefaultClient,
+	}
+}
+
+// WithContext returns a copy of the driver whose operations use ctx.
+func (d *EtcdDriver) WithContext(ctx context.Context) *EtcdDriver {
+	c := *d
+	c.ctx = ctx
+	return &c
+}
+
+func (d *EtcdDriver) do(op string, body etcdRequest) (*etcdResponse, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	err = errors.New("acdb: no etcd endpoint")
+	for _, e := range d.endpoints {
+		var req *http.Request
+		req, err = http.NewRequestWithContext(d.ctx, http.MethodPost, e+"/v3/kv/"+op, bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		var res *http.Response
+		res, err = d.client.Do(req)
+		if err != nil {
+			if d.ctx.Err() != nil {
+				return nil, err
+			}
+			continue
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(res.Body)
+			return nil, fmt.Errorf("acdb: etcd %s: %s: %s", op, res.Status, msg)
+		}
+		r := &etcdResponse{}
+		return r, json.NewDecoder(res.Body).Decode(r)
+	}
+	return nil, err
+}
+
+func (d *EtcdDriver) Get(k string) ([]byte, error) {
+	r, err := d.do("range", etcdRequest{Key: []byte(d.prefix + k)})
+	if err != nil {
+		return nil, err
+	}
+	if len(r.Kvs) == 0 {
+		return nil, os.ErrNotExist
+	}
+	if r.Kvs[0].Value == nil {
+		return []byte{}, nil
+	}
+	return r.Kvs[0].Value, nil
+}
+
+func (d *EtcdDriver) Set(k string, v []byte) error {
+	_, err := d.do("put", etcdRequest{Key: []byte(d.prefix + k), Value: v})
+	return err
+}
+
+func (d *EtcdDriver) Del(k string) error {
+	r, err := d.do("deleterange", etcdRequest{Key: []byte(d.prefix + k)})
+	if err != nil {
+		return err
+	}
+	if r.Deleted == "" || r.Deleted == "0" {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// Keys returns all keys under the prefix, with the prefix removed.
+func (d *EtcdDriver) Keys() ([]string, error) {
+	// The range end is the prefix with its last byte incremented, or "\x00" meaning all keys for an empty prefix.
+	end := []byte{0}
+	if d.prefix != "" {
+		end = []byte(d.prefix)
+		for i := len(end) - 1; i >= 0; i-- {
+			if end[i] < 0xff {
+				end[i]++
+				end = end[:i+1]
+				break
+			}
+			if i == 0 {
+				end = []byte{0}
+			}
+		}
+	}
+	key := []byte(d.prefix)
+	if d.prefix == "" {
+		key = []byte{0}
+	}
+	r, err := d.do("range", etcdRequest{Key: key, RangeEnd: end, KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	l := make([]string, len(r.Kvs))
+	for i, e := range r.Kvs {
+		l[i] = strings.TrimPrefix(string(e.Key), d.prefix)
+	}
+	return l, nil
+}
+
+// JetStreamDriver stores keys in a NATS JetStream key-value bucket. It speaks the NATS client protocol itself over the
+// given connection, so it needs no client library, and supports servers without authentication or TLS only. Get reads
+// the last message of the subject of the key, a key deleted or purged in the bucket maps to ErrNotExist. Keys are
+// limited to the characters allowed by JetStream, letters, digits and "-/_=.", other keys fail with ErrInvalidKey.
+// Changes are not watched, so Watch of Emerge sees only the writes made through it.
+type JetStreamDriver struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	bucket  string
+	inbox   string
+	seq     int
+	timeout time.Duration
+}
+
+type jsError struct {
+	Code        int    `json:"code"`
+	Description string `json:"description"`
+}
+
+func (e *jsError) Error() string {
+	return fmt.Sprintf("acdb: jetstream: %d %s", e.Code, e.Description)
+}
+
+type jsResponse struct {
+	Error   *jsError `json:"error"`
+	Message struct {
+		Hdrs []byte `json:"hdrs"`
+		Data []byte `json:"data"`
+	} `json:"message"`
+}
+
+var jsKey = regexp.MustCompile(`^[-/_=.a-zA-Z0-9]+$`)
+
+// NewJetStreamDriver returns a JetStreamDriver on conn, a connection to a NATS server, e.g. from
+// net.Dial("tcp", "127.0.0.1:4222"). The bucket must exist. The driver owns conn and closes it on Close.
+func NewJetStreamDriver(conn net.Conn, bucket string) (*JetStreamDriver, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	d := &JetStreamDriver{
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		bucket:  bucket,
+		inbox:   "_INBOX." + hex.EncodeToString(id),
+		timeout: 5 * time.Second,
+	}
+	conn.SetDeadline(time.Now().Add(d.timeout))
+	defer conn.SetDeadline(time.Time{})
+	l, err := d.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(l, "INFO ") {
+		return nil, fmt.Errorf("acdb: nats: unexpected %q", strings.TrimSpace(l))
+	}
+	info := struct {
+		Headers bool `json:"headers"`
+		Auth    bool `json:"auth_required"`
+		TLS     bool `json:"tls_required"`
+	}{}
+	if err := json.Unmarshal([]byte(l[5:]), &info); err != nil {
+		return nil, err
+	}
+	if !info.Headers || info.Auth || info.TLS {
+		return nil, fmt.Errorf("acdb: nats: server requires headers, no authentication and no tls: %w", ErrUnsupported)
+	}
+	connect := `CONNECT {"verbose":false,"pedantic":false,"headers":true,"no_responders":true,"protocol":1}`
+	if _, err := fmt.Fprintf(conn, "%s\r\nSUB %s.* 1\r\nPING\r\n", connect, d.inbox); err != nil {
+		return nil, err
+	}
+	for {
+		l, err := d.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		switch l = strings.TrimSpace(l); {
+		case l == "PONG":
+			return d, nil
+		case strings.HasPrefix(l, "-ERR"):
+			return nil, fmt.Errorf("acdb: nats: %s", l)
+		}
+	}
+}
+
+// SetTimeout bounds the time every operation waits for the server, 5 seconds by default. An operation which times out
+// leaves the connection broken, create a new driver then.
+func (d *JetStreamDriver) SetTimeout(t time.Duration) {
+	d.timeout = t
+}
+
+// request publishes the payload with the headers hdr, if any, to subject and returns the headers and the payload of the
+// reply.
+func (d *JetStreamDriver) request(subject string, hdr []byte, payload []byte) ([]byte, []byte, error) {
+	d.seq++
+	reply := d.inbox + "." + strconv.Itoa(d.seq)
+	d.conn.SetDeadline(time.Now().Add(d.timeout))
+	defer d.conn.SetDeadline(time.Time{})
+	b := []byte{}
+	if hdr == nil {
+		b = append(b, fmt.Sprintf("PUB %s %s %d\r\n", subject, reply, len(payload))...)
+	} else {
+		b = append(b, fmt.Sprintf("HPUB %s %s %d %d\r\n", subject, reply, len(hdr), len(hdr)+len(payload))...)
+		b = append(b, hdr...)
+	}
+	b = append(b, payload...)
+	b = append(b, "\r\n"...)
+	if _, err := d.conn.Write(b); err != nil {
+		return nil, nil, err
+	}
+	for {
+		l, err := d.r.ReadString('\n')
+		if err != nil {
+			return nil, nil, err
+		}
+		f := strings.Fields(l)
+		if len(f) == 0 {
+			continue
+		}
+		switch f[0] {
+		case "PING":
+			if _, err := d.conn.Write([]byte("PONG\r\n")); err != nil {
+				return nil, nil, err
+			}
+			continue
+		case "-ERR":
+			return nil, nil, fmt.Errorf("acdb: nats: %s", strings.TrimSpace(l))
+		case "MSG", "HMSG":
+		default:
+			continue
+		}
+		// MSG subject sid [reply] size, HMSG subject sid [reply] header-size total-size.
+		if len(f) < 4 {
+			return nil, nil, fmt.Errorf("acdb: nats: malformed %q", strings.TrimSpace(l))
+		}
+		hs, ts := "0", f[len(f)-1]
+		if f[0] == "HMSG" {
+			hs = f[len(f)-2]
+		}
+		hn, err1 := strconv.Atoi(hs)
+		tn, err2 := strconv.Atoi(ts)
+		if err1 != nil || err2 != nil || hn < 0 || hn > tn {
+			return nil, nil, fmt.Errorf("acdb: nats: malformed %q", strings.TrimSpace(l))
+		}
+		m := make([]byte, tn+2)
+		if _, err := io.ReadFull(d.r, m); err != nil {
+			return nil, nil, err
+		}
+		// Replies to earlier requests which timed out are skipped.
+		if f[1] != reply {
+			continue
+		}
+		if bytes.HasPrefix(m[:hn], []byte("NATS/1.0 503")) {
+			return nil, nil, fmt.Errorf("acdb: nats: no responders on %s", subject)
+		}
+		return m[:hn], m[hn:tn], nil
+	}
+}
+
+// api sends a request to the JetStream API or to a subject of the bucket and decodes the json reply. An error reply
+// is returned as a *jsError.
+func (d *JetStreamDriver) api(subject string, hdr []byte, payload []byte) (*jsResponse, error) {
+	_, b, err := d.request(subject, hdr, payload)
+	if err != nil {
+		return nil, err
+	}
+	r := &jsResponse{}
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, err
+	}
+	if r.Error != nil {
+		return nil, r.Error
+	}
+	return r, nil
+}
+
+func (d *JetStreamDriver) subject(k string) (string, error) {
+	if !jsKey.MatchString(k) || strings.HasPrefix(k, ".") || strings.HasSuffix(k, ".") {
+		return "", ErrInvalidKey
+	}
+	return "$KV." + d.bucket + "." + k, nil
+}
+
+func (d *JetStreamDriver) Get(k string) ([]byte, error) {
+	s, err := d.subject(k)
+	if err != nil {
+		return nil, err
+	}
+	q, err := json.Marshal(map[string]string{"last_by_subj": s})
+	if err != nil {
+		return nil, err
+	}
+	r, err := d.api("$JS.API.STREAM.MSG.GET.KV_"+d.bucket, nil, q)
+	if e, ok := err.(*jsError); ok && e.Code == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range strings.Split(string(r.Message.Hdrs), "\r\n") {
+		if n := strings.Index(l, ":"); n >= 0 && strings.TrimSpace(l[:n]) == "KV-Operation" {
+			return nil, os.ErrNotExist
+		}
+	}
+	if r.Message.Data == nil {
+		return []byte{}, nil
+	}
+	return r.Message.Data, nil
+}
+
+func (d *JetStreamDriver) Set(k string, v []byte) error {
+	s, err := d.subject(k)
+	if err != nil {
+		return err
+	}
+	_, err = d.api(s, nil, v)
+	return err
+}
+
+// Del writes a delete marker for k, like the Delete of the NATS clients. It reads the key first to report a missing
+// one with ErrNotExist.
+func (d *JetStreamDriver) Del(k string) error {
+	if _, err := d.Get(k); err != nil {
+		return err
+	}
+	s, err := d.subject(k)
+	if err != nil {
+		return err
+	}
+	_, err = d.api(s, []byte("NATS/1.0\r\nKV-Operation: DEL\r\n\r\n"), nil)
+	return err
+}
+
+// Close closes the connection.
+func (d *JetStreamDriver) Close() error {
+	return d.conn.Close()
+}
+
+// BackupDriver mirrors every write to a backup driver, e.g. a DocDriver on another disk. Reads only go to the primary
+// driver and writes return as soon as the primary driver is done. The backup is written in the background by a single
+// goroutine in the order of the writes. It is best effort: when the queue is full or the backup fails, the write is
+// skipped and counted by Failures. Close waits for the queued writes.
+type BackupDriver struct {
+	failed   uint64
+	repaired uint64
+	writes   uint64
+	primary  Driver
+	backup   Driver
+	queue    chan backupOp
+	fixes    chan backupOp
+	done     chan struct{}
+	repair   bool
+}
+
+// backupOp is a write of the backup, or a read repair if it is sent to fixes. The seq of a read repair is the number
+// of writes queued before it.
+type backupOp struct {
+	del bool
+	k   string
+	v   []byte
+	seq uint64
+}
+
+// NewBackupDriver returns a BackupDriver.
+func NewBackupDriver(primary Driver, backup Driver) *BackupDriver {
+	d := &BackupDriver{
+		primary: primary,
+		backup:  backup,
+		queue:   make(chan backupOp, 1024),
+		fixes:   make(chan backupOp, 64),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(d.done)
+		for {
+			// Writes go first, read repairs are applied only while no write is waiting.
+			select {
+			case op, ok := <-d.queue:
+				if !ok {
+					return
+				}
+				d.write(op)
+				continue
+			default:
+			}
+			select {
+			case op, ok := <-d.queue:
+				if !ok {
+					return
+				}
+				d.write(op)
+			case op := <-d.fixes:
+				d.fix(op)
+			}
+		}
+	}()
+	return d
+}
+
+// write applies the write op to the backup.
+func (d *BackupDriver) write(op backupOp) {
+	var err error
+	if op.del {
+		err = d.backup.Del(op.k)
+	} else {
+		err = d.backup.Set(op.k, op.v)
+	}
+	if err != nil && !(op.del && errors.Is(err, os.ErrNotExist)) {
+		atomic.AddUint64(&d.failed, 1)
+	}
+}
+
+func (d *BackupDriver) enqueue(op backupOp) {
+	atomic.AddUint64(&d.writes, 1)
+	select {
+	case d.queue <- op:
+	default:
+		atomic.AddUint64(&d.failed, 1)
+	}
+}
+
+// enqueueFix queues a read repair op. Read repairs have a queue of their own and are dropped when it is full, so they
+// never take the place of a write.
+func (d *BackupDriver) enqueueFix(op backupOp) {
+	op.seq = atomic.LoadUint64(&d.writes)
+	select {
+	case d.fixes <- op:
+	default:
+	}
+}
+
+func (d *BackupDriver) Get(k string) ([]byte, error) {
+	v, err := d.primary.Get(k)
+	if d.repair {
+		switch {
+		case err == nil:
+			d.enqueueFix(backupOp{k: k, v: append([]byte{}, v...)})
+		case errors.Is(err, os.ErrNotExist):
+			d.enqueueFix(backupOp{del: true, k: k})
+		}
+	}
+	return v, err
+}
+
+// SetReadRepair makes every Get compare the value of the backup with the one read from the primary in the background,
+// and write it to the backup if it is missing or differs, or delete it if the primary has no such key. So the backup
+// converges on the keys in use even after writes were skipped. It costs a read of the backup per Get. Repairs are
+// best effort and yield to writes: they wait in a queue of their own, they are dropped when it is full, and a repair is
+// dropped if any write was queued after it, since the value it carries may be outdated by then. Call it before the
+// driver is used.
+func (d *BackupDriver) SetReadRepair(b bool) {
+	d.repair = b
+}
+
+// fix applies the read repair op to the backup, unless a write was queued after it.
+func (d *BackupDriver) fix(op backupOp) {
+	if atomic.LoadUint64(&d.writes) != op.seq {
+		return
+	}
+	v, err := d.backup.Get(op.k)
+	switch {
+	case op.del && err == nil:
+		err = d.backup.Del(op.k)
+	case op.del && errors.Is(err, os.ErrNotExist):
+		return
+	case !op.del && (errors.Is(err, os.ErrNotExist) || err == nil && !bytes.Equal(v, op.v)):
+		err = d.backup.Set(op.k, op.v)
+	case err == nil:
+		return
+	}
+	if err != nil {
+		atomic.AddUint64(&d.failed, 1)
+		return
+	}
+	atomic.AddUint64(&d.repaired, 1)
+}
+
+// Repairs returns the number of keys fixed in the backup by read repair.
+func (d *BackupDriver) Repairs() uint64 {
+	return atomic.LoadUint64(&d.repaired)
+}
+
+func (d *BackupDriver) Set(k string, v []byte) error {
+	if err := d.primary.Set(k, v); err != nil {
+		return err
+	}
+	d.enqueue(backupOp{k: k, v: append([]byte{}, v...)})
+	return nil
+}
+
+func (d *BackupDriver) Del(k string) error {
+	if err := d.primary.Del(k); err != nil {
+		return err
+	}
+	d.enqueue(backupOp{del: true, k: k})
+	return nil
+}
+
+// Failures returns the number of writes which did not reach the backup.
+func (d *BackupDriver) Failures() uint64 {
+	return atomic.LoadUint64(&d.failed)
+}
+
+// Close waits until the queued writes are applied to the backup. The driver must not be used after.
+func (d *BackupDriver) Close() error {
+	close(d.queue)
+	<-d.done
+	return nil
+}
+
+// CompressDriver compresses values of at least min bytes with gzip. Smaller values are stored as they are, since gzip
+// framing would make them larger. The stored value starts with one byte telling how it is stored, 0 for plain and 1
+// for gzip. A min of 512 is a good start.
+type CompressDriver struct {
+	driver Driver
+	min    int
+}
+
+// NewCompressDriver returns a CompressDriver.
+func NewCompressDriver(driver Driver, min int) *CompressDriver {
+	return &CompressDriver{
+		driver: driver,
+		min:    min,
+	}
+}
+
+func (d *CompressDriver) Get(k string) ([]byte, error) {
+	b, err := d.driver.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, ErrCorrupt
+	}
+	switch b[0] {
+	case 0:
+		return b[1:], nil
+	case 1:
+		r, err := gzip.NewReader(bytes.NewReader(b[1:]))
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(r)
+	}
+	return nil, ErrCorrupt
+}
+
+func (d *CompressDriver) Set(k string, v []byte) error {
+	if len(v) < d.min {
+		return d.driver.Set(k, append([]byte{0}, v...))
+	}
+	buf := bytes.NewBuffer([]byte{1})
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(v); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return d.driver.Set(k, buf.Bytes())
+}
+
+func (d *CompressDriver) Del(k string) error {
+	return d.driver.Del(k)
+}
+
+// ExpireDriver stores the expiry time along with every value, so it lives as long as the value does, e.g. it survives a
+// restart with DocDriver or a persisted MemDriver. Expiry is lazy: Get deletes an expired key and returns ErrExpired,
+// keys which are never read again stay in the driver. The stored value starts with the expiry as 8 bytes of big endian
+// unix nanoseconds, 0 for never.
+type ExpireDriver struct {
+	driver Driver
+}
+
+// NewExpireDriver returns a ExpireDriver.
+func NewExpireDriver(driver Driver) *ExpireDriver {
+	return &ExpireDriver{driver: driver}
+}
+
+func (d *ExpireDriver) Get(k string) ([]byte, error) {
+	b, err := d.driver.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 8 {
+		return nil, ErrCorrupt
+	}
+	if t := int64(binary.BigEndian.Uint64(b)); t != 0 && time.Now().UnixNano() >= t {
+		if err := d.driver.Del(k); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		return nil, ErrExpired
+	}
+	return b[8:], nil
+}
+
+// Set sets the value without expiry.
+func (d *ExpireDriver) Set(k string, v []byte) error {
+	return d.SetExpire(k, v, time.Time{})
+}
+
+// SetExpire sets the value to expire at t, a zero t means never.
+func (d *ExpireDriver) SetExpire(k string, v []byte, t time.Time) error {
+	b := make([]byte, 8, 8+len(v))
+	if !t.IsZero() {
+		binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+	}
+	return d.driver.Set(k, append(b, v...))
+}
+
+func (d *ExpireDriver) Del(k string) error {
+	return d.driver.Del(k)
+}
+
+// FaultDriver wraps a driver and makes its operations fail on demand, it is intended for testing the error handling of
+// code that uses acdb. A rule receives the operation name ("get", "set" or "del"), the key and the 1-based count of
+// calls of the operation so far. The first rule returning a non-nil error makes the call fail with that error without
+// touching the inner driver.
+type FaultDriver struct {
+	driver Driver
+	rules  []func(op string, k string, n int) error
+	count  map[string]int
+}
+
+// NewFaultDriver returns a FaultDriver.
+func NewFaultDriver(driver Driver) *FaultDriver {
+	return &FaultDriver{
+		driver: driver,
+		rules:  []func(op string, k string, n int) error{},
+		count:  map[string]int{},
+	}
+}
+
+// Fail adds a rule.
+func (d *FaultDriver) Fail(rule func(op string, k string, n int) error) {
+	d.rules = append(d.rules, rule)
+}
+
+// FailKey makes the operation op on key k fail with err.
+func (d *FaultDriver) FailKey(op string, k string, err error) {
+	d.Fail(func(o string, x string, _ int) error {
+		if o == op && x == k {
+			return err
+		}
+		return nil
+	})
+}
+
+// FailEvery makes every n-th call of the operation op fail with err.
+func (d *FaultDriver) FailEvery(op string, n int, err error) {
+	d.Fail(func(o string, _ string, c int) error {
+		if o == op && c%n == 0 {
+			return err
+		}
+		return nil
+	})
+}
+
+func (d *FaultDriver) fault(op string, k string) error {
+	d.count[op]++
+	for _, rule := range d.rules {
+		if err := rule(op, k, d.count[op]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *FaultDriver) Get(k string) ([]byte, error) {
+	if err := d.fault("get", k); err != nil {
+		return nil, err
+	}
+	return d.driver.Get(k)
+}
+
+func (d *FaultDriver) Set(k string, v []byte) error {
+	if err := d.fault("set", k); err != nil {
+		return err
+	}
+	return d.driver.Set(k, v)
+}
+
+func (d *FaultDriver) Del(k string) error {
+	if err := d.fault("del", k); err != nil {
+		return err
+	}
+	return d.driver.Del(k)
+}
+
+// formatMagic starts the tag of a value written by SetEncodeFormat, followed by the format name and a null byte. No
+// json text starts with a null byte, so untagged json values are never mistaken for tagged ones.
+const formatMagic = "\x00acdb:"
+
+type format struct {
+	marshal   func(v interface{}) ([]byte, error)
+	unmarshal func(b []byte, v interface{}) error
+}
+
+var formats = map[string]format{
+	"json": {marshal: json.Marshal, unmarshal: json.Unmarshal},
+	"gob": {
+		marshal: func(v interface{}) ([]byte, error) {
+			buf := &bytes.Buffer{}
+			err := gob.NewEncoder(buf).Encode(v)
+			return buf.Bytes(), err
+		},
+		unmarshal: func(b []byte, v interface{}) error {
+			return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+		},
+	},
+}
+
+// RegisterFormat makes a format available to SetEncodeFormat and GetDecode under name. The formats json and gob are
+// registered by default. It is not concurrency-safety and should be called at init time.
+func RegisterFormat(
+	name string,
+	marshal func(v interface{}) ([]byte, error),
+	unmarshal func(b []byte, v interface{}) error,
+) {
+	formats[name] = format{marshal: marshal, unmarshal: unmarshal}
+}
+
+// untag splits a value into its format name and payload. Untagged values are json.
+func untag(b []byte) (string, []byte) {
+	if !bytes.HasPrefix(b, []byte(formatMagic)) {
+		return "json", b
+	}
+	i := bytes.IndexByte(b[len(formatMagic):], 0)
+	if i < 0 {
+		return "json", b
+	}
+	return string(b[len(formatMagic) : len(formatMagic)+i]), b[len(formatMagic)+i+1:]
+}
+
+// Client is the interface of Emerge as it was first released. It is kept as it is, so types implementing it keep
+// doing so; operations added since are methods of Emerge only.
+type Client interface {
+	Get(k string) ([]byte, error)
+	Set(k string, v []byte) error
+	GetDecode(string, interface{}) error
+	SetEncode(string, interface{}) error
+	Del(k string) error
+}
+
+// Event describes a change made to a key, Op is "set", "del" or "expire". An expire event is sent when a read finds
+// the key expired and removes it.
+type Event struct {
+	Op  string
+	Key string
+}
+
+// Emerge is a actuator of the given drive. Do not worry, Is's concurrency-safety: every operation holds one lock for
+// its whole duration, so operations are serialized and the driver is never entered by two goroutines at once. Readers
+// returned by Open are read after the lock is released.
+//
+// Keys ending with a suffix in Sidecars are reserved for the data Emerge keeps beside a key, e.g. the timestamp of
+// SetTimestamped: operations on them fail with ErrInvalidKey, and Keys and KeysPage leave them out. Backup and
+// ImportDir carry them along with the keys they belong to.
+type Emerge struct {
+	driver  Driver
+	m       *sync.Mutex
+	wm      sync.Mutex
+	watcher map[chan Event]struct{}
+	events  chan Event
+	done    chan struct{}
+	maxKey  int
+	number  bool
+	closed  bool
+	onError func(k string, v interface{}, err error) (interface{}, error)
+	written map[string]struct{}
+	panics  bool
+	maxWait int
+	norm    func(k string) string
+	waits   map[string][]chan struct{}
+	polls   []func()
 }
 
 // NewEmerge returns a Emerge.
 func NewEmerge(driver Driver) *Emerge {
-	return &Emerge{driver: driver, m: &sync.Mutex{}}
+	e := &Emerge{driver: driver, m: &sync.Mutex{}, watcher: map[chan Event]struct{}{}}
+	if l, ok := driver.(KeyLimiter); ok {
+		e.maxKey = l.MaxKeyLen()
+	}
+	return e
+}
+
+// NewEmergeStrict returns a Emerge which allows every key to be set only once until it is deleted, a testing aid to
+// catch duplicate writes. Setting a key again fails with ErrOverwrite, or panics with the error if panics is true. Only
+// writes made through this Emerge are tracked, SetExpire and SetTimestamped included, and the keys Emerge keeps beside
+// others, e.g. the "~ts" key of SetTimestamped, are exempt. Do not use it in production, it remembers every key ever
+// written.
+func NewEmergeStrict(driver Driver, panics bool) *Emerge {
+	e := NewEmerge(driver)
+	e.written = map[string]struct{}{}
+	e.panics = panics
+	return e
+}
+
+// SetMaxKeyLen makes every operation on a key longer than n bytes fail with ErrInvalidKey before reaching the driver,
+// n = 0 means no limit. The default is given by the driver if it is a KeyLimiter, otherwise there is no limit.
+func (e *Emerge) SetMaxKeyLen(n int) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	e.maxKey = n
+}
+
+// SetKeyNormalizer makes every key pass through f before it reaches the driver, e.g. strings.ToLower folds keys from
+// case insensitive sources, so "Foo" and "foo" name the same entry also on a case sensitive file system. f must be
+// idempotent, f(f(k)) == f(k). Keys listed by Keys and sent to watchers are the normalized ones. It is off by default;
+// enable it before the first write, keys stored before are not normalized.
+func (e *Emerge) SetKeyNormalizer(f func(k string) string) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	e.norm = f
+}
+
+// SetMaxWatchers limits the number of watchers at once to n, Watch fails with ErrTooManyWatchers beyond, n = 0 means
+// no limit. Every watcher costs a channel send per write, so a limit catches watchers which are never stopped. The
+// default is no limit.
+func (e *Emerge) SetMaxWatchers(n int) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	e.maxWait = n
+}
+
+// SetUseNumber makes GetDecode decode json numbers into interface{} values as json.Number instead of float64, which
+// keeps the precision of large integers such as 64-bit ids. It is off by default.
+func (e *Emerge) SetUseNumber(b bool) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	e.number = b
+}
+
+// SetEncodeErrorHandler sets a function called when SetEncode or SetEncodeFormat fails to encode v, e.g. to log the
+// value or replace it with an encodable one. It returns the value to encode instead, or an error to fail the write
+// with. Nothing is written unless the encoding succeeds, so a failed write keeps the previous value.
+func (e *Emerge) SetEncodeErrorHandler(f func(k string, v interface{}, err error) (interface{}, error)) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	e.onError = f
+}
+
+// encode encodes v with marshal, and retries once with the value given by the encode error handler if it fails.
+func (e *Emerge) encode(k string, v interface{}, marshal func(v interface{}) ([]byte, error)) ([]byte, error) {
+	b, err := marshal(v)
+	if err == nil {
+		return b, nil
+	}
+	e.m.Lock()
+	f := e.onError
+	e.m.Unlock()
+	if f == nil {
+		return nil, err
+	}
+	if v, err = f(k, v, err); err != nil {
+		return nil, err
+	}
+	return marshal(v)
+}
+
+// Sidecars are the suffixes of the keys reserved by Emerge, see Emerge.
+var Sidecars = []string{"~ts", "~meta"}
+
+// IsSidecar reports whether k is reserved by Emerge, see Emerge.
+func IsSidecar(k string) bool {
+	for _, s := range Sidecars {
+		if strings.HasSuffix(k, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// key normalizes k, and validates it and that the Emerge is not closed. It must be called with the lock held.
+func (e *Emerge) key(k string) (string, error) {
+	if e.closed {
+		return k, ErrClosed
+	}
+	if e.norm != nil {
+		k = e.norm(k)
+	}
+	if e.maxKey > 0 && len(k) > e.maxKey || IsSidecar(k) {
+		return k, ErrInvalidKey
+	}
+	return k, nil
+}
+
+// side returns the normalized k and its sidecar key with the given suffix, after validating both, so a key whose
+// sidecar is too long is refused before anything is written. It must be called with the lock held.
+func (e *Emerge) side(k string, suffix string) (string, string, error) {
+	k, err := e.key(k)
+	if err != nil {
+		return k, "", err
+	}
+	if e.maxKey > 0 && len(k+suffix) > e.maxKey {
+		return k, "", ErrInvalidKey
+	}
+	return k, k + suffix, nil
+}
+
+// get, set and del check the key, call the driver and wrap errors in an OpError.
+func (e *Emerge) get(k string) ([]byte, error) {
+	k, err := e.key(k)
+	if err != nil {
+		return nil, &OpError{Op: "get", Key: k, Err: err}
+	}
+	v, err := e.driver.Get(k)
+	if errors.Is(err, ErrExpired) {
+		e.emit("expire", k)
+	}
+	if err != nil {
+		return nil, &OpError{Op: "get", Key: k, Err: err}
+	}
+	return v, nil
+}
+
+func (e *Emerge) set(k string, v []byte) error {
+	k, err := e.key(k)
+	if err != nil {
+		return &OpError{Op: "set", Key: k, Err: err}
+	}
+	if err := e.once(k); err != nil {
+		return err
+	}
+	if err := e.driver.Set(k, v); err != nil {
+		return &OpError{Op: "set", Key: k, Err: err}
+	}
+	e.wrote(k)
+	return nil
+}
+
+// sidecar sets the sidecar key s returned by side, or deletes it if v is nil. It is rewritten with the key it belongs
+// to, so a strict Emerge does not track it.
+func (e *Emerge) sidecar(s string, v []byte) error {
+	if v == nil {
+		if err := e.driver.Del(s); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return &OpError{Op: "del", Key: s, Err: err}
+		}
+		return nil
+	}
+	if err := e.driver.Set(s, v); err != nil {
+		return &OpError{Op: "set", Key: s, Err: err}
+	}
+	return nil
+}
+
+// once fails, or panics, if the Emerge is strict and the normalized key k was written and not deleted since. It must be
+// called before anything is written.
+func (e *Emerge) once(k string) error {
+	if _, b := e.written[k]; b {
+		err := &OpError{Op: "set", Key: k, Err: ErrOverwrite}
+		if e.panics {
+			panic(err)
+		}
+		return err
+	}
+	return nil
+}
+
+// wrote records that the normalized key k was written, if the Emerge is strict.
+func (e *Emerge) wrote(k string) {
+	if e.written != nil {
+		e.written[k] = struct{}{}
+	}
+}
+
+func (e *Emerge) del(k string) error {
+	k, err := e.key(k)
+	if err != nil {
+		return &OpError{Op: "del", Key: k, Err: err}
+	}
+	if err := e.driver.Del(k); err != nil {
+		return &OpError{Op: "del", Key: k, Err: err}
+	}
+	delete(e.written, k)
+	// The metadata of SetMeta goes with the value. A key too long to have any is spared the lookup.
+	if e.maxKey == 0 || len(k+"~meta") <= e.maxKey {
+		return e.sidecar(k+"~meta", nil)
+	}
+	return nil
+}
+
+// emit wakes the callers of Wait on k if it is set, and queues the event for the watchers, so a write costs the same
+// whatever the number of watchers. It must be called with the lock held. Events are dropped if the queue is full, the
+// callers of Wait are always woken.
+func (e *Emerge) emit(op string, k string) {
+	if e.norm != nil {
+		k = e.norm(k)
+	}
+	if op == "set" {
+		for _, c := range e.waits[k] {
+			close(c)
+		}
+		delete(e.waits, k)
+	}
+	if e.events == nil {
+		return
+	}
+	select {
+	case e.events <- Event{Op: op, Key: k}:
+	default:
+	}
+}
+
+// dispatch sends the queued events to all watchers in the order they were emitted, until the queue is closed. Then it
+// closes the channels of all watchers.
+func (e *Emerge) dispatch() {
+	for ev := range e.events {
+		e.wm.Lock()
+		for c := range e.watcher {
+			select {
+			case c <- ev:
+			default:
+			}
+		}
+		e.wm.Unlock()
+	}
+	e.wm.Lock()
+	for c := range e.watcher {
+		delete(e.watcher, c)
+		close(c)
+	}
+	e.wm.Unlock()
+	close(e.done)
 }
 
 func (e *Emerge) Get(k string) ([]byte, error) {
 	e.m.Lock()
 	defer e.m.Unlock()
-	return e.driver.Get(k)
+	return e.get(k)
 }
 func (e *Emerge) Set(k string, v []byte) error {
 	e.m.Lock()
 	defer e.m.Unlock()
-	return e.driver.Set(k, v)
+	if err := e.set(k, v); err != nil {
+		return err
+	}
+	e.emit("set", k)
+	return nil
+}
+
+// SetReport sets the value and reports whether it created the key rather than overwrote it. The key is looked up and
+// set under a single lock acquisition, so no write can happen in between. It costs a Get of the key.
+func (e *Emerge) SetReport(k string, v []byte) (bool, error) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	_, err := e.get(k)
+	created := errors.Is(err, os.ErrNotExist)
+	if err != nil && !created {
+		return false, err
+	}
+	if err := e.set(k, v); err != nil {
+		return false, err
+	}
+	e.emit("set", k)
+	return created, nil
 }
 
+// GetDecode decodes the value into v with the format it was encoded in, values without a format tag are json.
 func (e *Emerge) GetDecode(k string, v interface{}) error {
 	b, err := e.Get(k)
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(b, v)
+	return e.decode(b, v)
+}
+
+// GetDecodeBuffer is like GetDecode, but reads the value into buf, which is reset first. Reusing buffers, e.g. from a
+// sync.Pool, saves allocating the value on every call when the driver is an Opener. buf must not be used by others
+// until it returns.
+func (e *Emerge) GetDecodeBuffer(k string, v interface{}, buf *bytes.Buffer) error {
+	buf.Reset()
+	if _, err := e.GetTo(k, buf); err != nil {
+		return err
+	}
+	return e.decode(buf.Bytes(), v)
+}
+
+// decode decodes the value into v. A value starting with the gzip magic number, e.g. one stored with Content-Encoding
+// gzip through cmd/acdb, is decompressed first. The magic number can not start a json document or a format tag, so
+// other values are never mistaken for gzip.
+func (e *Emerge) decode(b []byte, v interface{}) error {
+	if bytes.HasPrefix(b, []byte{0x1f, 0x8b}) {
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		if b, err = io.ReadAll(r); err != nil {
+			return err
+		}
+	}
+	f, b := untag(b)
+	e.m.Lock()
+	number := e.number
+	e.m.Unlock()
+	if f == "json" && number {
+		d := json.NewDecoder(bytes.NewReader(b))
+		d.UseNumber()
+		return d.Decode(v)
+	}
+	c, ok := formats[f]
+	if !ok {
+		return ErrUnsupported
+	}
+	return c.unmarshal(b, v)
 }
 
 func (e *Emerge) SetEncode(k string, v interface{}) error {
-	b, err := json.Marshal(v)
+	b, err := e.encode(k, v, json.Marshal)
 	if err != nil {
 		return err
 	}
 	return e.Set(k, b)
 }
 
+// SetEncodeFormat encodes v with the registered format and stores it with a tag naming the format, so GetDecode and
+// Format can tell how it was encoded. If the format is not registered, ErrUnsupported will be returned.
+func (e *Emerge) SetEncodeFormat(k string, v interface{}, format string) error {
+	c, ok := formats[format]
+	if !ok {
+		return ErrUnsupported
+	}
+	b, err := e.encode(k, v, c.marshal)
+	if err != nil {
+		return err
+	}
+	return e.Set(k, append([]byte(formatMagic+format+"\x00"), b...))
+}
+
+// Format returns the name of the format the value was encoded in. Values without a format tag are reported as json.
+func (e *Emerge) Format(k string) (string, error) {
+	b, err := e.Get(k)
+	if err != nil {
+		return "", err
+	}
+	f, _ := untag(b)
+	return f, nil
+}
+
 func (e *Emerge) Del(k string) error {
 	e.m.Lock()
 	defer e.m.Unlock()
-	return e.driver.Del(k)
+	if err := e.del(k); err != nil {
+		return err
+	}
+	e.emit("del", k)
+	return nil
+}
+
+// SetExpire sets the value to expire after ttl. If the driver is not an Expirer, ErrUnsupported will be returned.
+func (e *Emerge) SetExpire(k string, v []byte, ttl time.Duration) error {
+	e.m.Lock()
+	defer e.m.Unlock()
+	x, ok := e.driver.(Expirer)
+	if !ok {
+		return ErrUnsupported
+	}
+	k, err := e.key(k)
+	if err != nil {
+		return &OpError{Op: "set", Key: k, Err: err}
+	}
+	if err := e.once(k); err != nil {
+		return err
+	}
+	if err := x.SetExpire(k, v, time.Now().Add(ttl)); err != nil {
+		return &OpError{Op: "set", Key: k, Err: err}
+	}
+	e.wrote(k)
+	e.emit("set", k)
+	return nil
+}
+
+// GetDirect reads the value bypassing any cache of the driver, if it is a DirectGetter. Other drivers have no cache
+// and are read as usual.
+func (e *Emerge) GetDirect(k string) ([]byte, error) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	g, ok := e.driver.(DirectGetter)
+	if !ok {
+		return e.get(k)
+	}
+	k, err := e.key(k)
+	if err != nil {
+		return nil, &OpError{Op: "get", Key: k, Err: err}
+	}
+	v, err := g.GetDirect(k)
+	if err != nil {
+		return nil, &OpError{Op: "get", Key: k, Err: err}
+	}
+	return v, nil
+}
+
+// GetFresh returns the value only if it was set within maxAge, otherwise ErrStale will be returned. If the driver is
+// not a ModTimer, ErrUnsupported will be returned.
+func (e *Emerge) GetFresh(k string, maxAge time.Duration) ([]byte, error) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	m, ok := e.driver.(ModTimer)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	k, err := e.key(k)
+	if err != nil {
+		return nil, &OpError{Op: "get", Key: k, Err: err}
+	}
+	t, err := m.ModTime(k)
+	if err != nil {
+		return nil, &OpError{Op: "get", Key: k, Err: err}
+	}
+	if time.Since(t) > maxAge {
+		return nil, &OpError{Op: "get", Key: k, Err: ErrStale}
+	}
+	return e.get(k)
+}
+
+// GetSnapshot reads all given keys under a single lock acquisition, so the result is a consistent point in time view
+// that no concurrent write can tear. Keys which do not exist are absent from the result.
+func (e *Emerge) GetSnapshot(keys []string) (map[string][]byte, error) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	r := make(map[string][]byte, len(keys))
+	for _, k := range keys {
+		v, err := e.get(k)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		r[k] = v
+	}
+	return r, nil
+}
+
+// Swap exchanges the values of two keys atomically. If either key does not exist, ErrNotExist will be returned and
+// nothing is changed. If writing the second key fails, the first one is set back to its old value before the error is
+// returned.
+func (e *Emerge) Swap(a, b string) error {
+	e.m.Lock()
+	defer e.m.Unlock()
+	va, err := e.get(a)
+	if err != nil {
+		return err
+	}
+	vb, err := e.get(b)
+	if err != nil {
+		return err
+	}
+	if err := e.set(a, vb); err != nil {
+		return err
+	}
+	if err := e.set(b, va); err != nil {
+		// Put a back, so a failed swap leaves both keys as they were.
+		if k, err := e.key(a); err == nil {
+			e.driver.Set(k, va)
+		}
+		return err
+	}
+	e.emit("set", a)
+	e.emit("set", b)
+	return nil
+}
+
+// GetTo writes the value to w. The lock is released before anything is written, so a slow writer does not block other
+// operations. If the driver is an Opener the value is streamed from the opened reader and may observe a concurrent Set
+// partially, like a reader returned by Open; otherwise it is read as a whole first.
+func (e *Emerge) GetTo(k string, w io.Writer) (int64, error) {
+	r, err := e.Open(k)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return io.Copy(w, r)
+}
+
+// Open opens the value for random access reading. If the driver is an Opener the value is read lazily, otherwise it is
+// read as a whole first. The caller must close the returned reader.
+func (e *Emerge) Open(k string) (io.ReadSeekCloser, error) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	k, err := e.key(k)
+	if err != nil {
+		return nil, &OpError{Op: "get", Key: k, Err: err}
+	}
+	if o, ok := e.driver.(Opener); ok {
+		r, err := o.Open(k)
+		if err != nil {
+			return nil, &OpError{Op: "get", Key: k, Err: err}
+		}
+		return r, nil
+	}
+	v, err := e.get(k)
+	if err != nil {
+		return nil, err
+	}
+	return bytesReader{bytes.NewReader(v)}, nil
+}
+
+// SetMeta sets the value together with its metadata, e.g. the content type cmd/acdb serves it with, which OpenMeta
+// returns with the value. The metadata is stored under the key suffixed with "~meta", a nil meta deletes it. Both are
+// written under one lock and the metadata first, put back if writing the value fails, so readers never see a value
+// with the metadata of another. Set leaves the metadata as it is, Del deletes it.
+func (e *Emerge) SetMeta(k string, v []byte, meta []byte) error {
+	e.m.Lock()
+	defer e.m.Unlock()
+	k, s, err := e.side(k, "~meta")
+	if err != nil {
+		return &OpError{Op: "set", Key: k, Err: err}
+	}
+	if err := e.once(k); err != nil {
+		return err
+	}
+	old, err := e.driver.Get(s)
+	if errors.Is(err, os.ErrNotExist) {
+		old, err = nil, nil
+	}
+	if err != nil {
+		return &OpError{Op: "set", Key: k, Err: err}
+	}
+	if err := e.sidecar(s, meta); err != nil {
+		return err
+	}
+	if err := e.driver.Set(k, v); err != nil {
+		e.sidecar(s, old)
+		return &OpError{Op: "set", Key: k, Err: err}
+	}
+	e.wrote(k)
+	e.emit("set", k)
+	return nil
+}
+
+// OpenMeta is like Open, and also returns the metadata set by SetMeta, nil if there is none. Both are read under one
+// lock. Like for Open, a value read lazily from an Opener may observe a later Set partially.
+func (e *Emerge) OpenMeta(k string) (io.ReadSeekCloser, []byte, error) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	k, err := e.key(k)
+	if err != nil {
+		return nil, nil, &OpError{Op: "get", Key: k, Err: err}
+	}
+	var meta []byte
+	// A key too long to have metadata is spared the lookup.
+	if e.maxKey == 0 || len(k+"~meta") <= e.maxKey {
+		meta, err = e.driver.Get(k + "~meta")
+		if errors.Is(err, os.ErrNotExist) {
+			meta, err = nil, nil
+		}
+		if err != nil {
+			return nil, nil, &OpError{Op: "get", Key: k, Err: err}
+		}
+	}
+	if o, ok := e.driver.(Opener); ok {
+		r, err := o.Open(k)
+		if err != nil {
+			return nil, nil, &OpError{Op: "get", Key: k, Err: err}
+		}
+		return r, meta, nil
+	}
+	v, err := e.get(k)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bytesReader{bytes.NewReader(v)}, meta, nil
+}
+
+// SetTimestamped sets the value only if ts is newer than the timestamp of the stored value, the last write wins. The
+// timestamp is stored under the key suffixed with "~ts" and is kept on Del, so a late write older than the deletion is
+// still rejected. If the write is older, ErrOutdated will be returned and nothing is changed. The timestamp is written
+// first, and put back if writing the value fails, so a value is never stored without its timestamp.
+func (e *Emerge) SetTimestamped(k string, v []byte, ts time.Time) error {
+	e.m.Lock()
+	defer e.m.Unlock()
+	k, s, err := e.side(k, "~ts")
+	if err != nil {
+		return &OpError{Op: "set", Key: k, Err: err}
+	}
+	old, err := e.driver.Get(s)
+	if errors.Is(err, os.ErrNotExist) {
+		old, err = nil, nil
+	}
+	if err != nil {
+		return &OpError{Op: "set", Key: k, Err: err}
+	}
+	if old != nil {
+		n, err := strconv.ParseInt(string(old), 10, 64)
+		if err != nil {
+			return &OpError{Op: "set", Key: k, Err: err}
+		}
+		if !ts.After(time.Unix(0, n)) {
+			return &OpError{Op: "set", Key: k, Err: ErrOutdated}
+		}
+	}
+	if err := e.once(k); err != nil {
+		return err
+	}
+	if err := e.sidecar(s, []byte(strconv.FormatInt(ts.UnixNano(), 10))); err != nil {
+		return err
+	}
+	if err := e.driver.Set(k, v); err != nil {
+		e.sidecar(s, old)
+		return &OpError{Op: "set", Key: k, Err: err}
+	}
+	e.wrote(k)
+	e.emit("set", k)
+	return nil
+}
+
+// Keys returns all keys of the driver but the sidecars. If the driver is not a Lister, ErrUnsupported will be returned.
+func (e *Emerge) Keys() ([]string, error) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	if e.closed {
+		return nil, &OpError{Op: "keys", Err: ErrClosed}
+	}
+	if l, ok := e.driver.(Lister); ok {
+		r, err := l.Keys()
+		if err != nil {
+			return nil, &OpError{Op: "keys", Err: err}
+		}
+		n := 0
+		for _, k := range r {
+			if !IsSidecar(k) {
+				r[n] = k
+				n++
+			}
+		}
+		return r[:n], nil
+	}
+	return nil, ErrUnsupported
+}
+
+// KeysSorted returns all keys of the driver in lexicographic order.
+func (e *Emerge) KeysSorted() ([]string, error) {
+	r, err := e.Keys()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(r)
+	return r, nil
+}
+
+// KeysPage returns up to limit keys in lexicographic order, starting after the position of cursor. An empty cursor
+// starts from the beginning. The returned cursor resumes after the last returned key, it is empty once all keys are
+// returned. Cursors are opaque strings safe for use in urls. Keys set or deleted between pages are seen or not
+// depending on their position. The limit must be positive.
+func (e *Emerge) KeysPage(cursor string, limit int) ([]string, string, error) {
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("acdb: invalid limit %d", limit)
+	}
+	after, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, "", ErrInvalidKey
+	}
+	r, err := e.KeysSorted()
+	if err != nil {
+		return nil, "", err
+	}
+	i := 0
+	if cursor != "" {
+		i = sort.Search(len(r), func(i int) bool { return r[i] > string(after) })
+	}
+	r = r[i:]
+	if len(r) <= limit {
+		return r, "", nil
+	}
+	r = r[:limit]
+	return r, base64.RawURLEncoding.EncodeToString([]byte(r[limit-1])), nil
+}
+
+// CompareAndDelete deletes the key only if its current value equals old, and reports whether it deleted. If the key
+// does not exist, ErrNotExist will be returned.
+func (e *Emerge) CompareAndDelete(k string, old []byte) (bool, error) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	v, err := e.get(k)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(v, old) {
+		return false, nil
+	}
+	if err := e.del(k); err != nil {
+		return false, err
+	}
+	e.emit("del", k)
+	return true, nil
+}
+
+// restore sets the sidecar key s as it is, as read from a backup. No event is emitted.
+func (e *Emerge) restore(s string, v []byte) error {
+	e.m.Lock()
+	defer e.m.Unlock()
+	if e.closed {
+		return &OpError{Op: "set", Key: s, Err: ErrClosed}
+	}
+	if e.maxKey > 0 && len(s) > e.maxKey {
+		return &OpError{Op: "set", Key: s, Err: ErrInvalidKey}
+	}
+	return e.sidecar(s, v)
+}
+
+// ImportDir walks the directory fsRoot and sets every regular file as a key, named by its path relative to fsRoot and
+// separated by slashes, with the file contents as the value. If filter is not nil, only files whose relative path it
+// accepts are imported. It returns the number of imported files; the import stops at the first error, keys set before
+// are kept.
+func (e *Emerge) ImportDir(fsRoot string, filter func(p string) bool) (int, error) {
+	n := 0
+	err := filepath.Walk(fsRoot, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(fsRoot, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if filter != nil && !filter(rel) {
+			return nil
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if IsSidecar(rel) {
+			err = e.restore(rel, b)
+		} else {
+			err = e.Set(rel, b)
+		}
+		if err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// Watch returns a channel receiving an Event for every successful change made through this Emerge, and a function to
+// stop watching which closes the channel. Changes made to the driver by others are not seen. The channel is buffered,
+// events are dropped if the buffer is full, so the receiver should not fall behind. Stopped watchers are removed at
+// once and cost nothing afterwards. Events are delivered by a background goroutine, started by the first Watch, in the
+// order of the changes; an event may arrive shortly after the write which caused it has returned.
+func (e *Emerge) Watch() (<-chan Event, func(), error) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	if e.closed {
+		return nil, nil, ErrClosed
+	}
+	e.wm.Lock()
+	defer e.wm.Unlock()
+	if e.maxWait > 0 && len(e.watcher) >= e.maxWait {
+		return nil, nil, ErrTooManyWatchers
+	}
+	if e.events == nil {
+		e.events = make(chan Event, 1024)
+		e.done = make(chan struct{})
+		go e.dispatch()
+	}
+	c := make(chan Event, 64)
+	e.watcher[c] = struct{}{}
+	return c, func() {
+		e.wm.Lock()
+		defer e.wm.Unlock()
+		if _, b := e.watcher[c]; b {
+			delete(e.watcher, c)
+			close(c)
+		}
+	}, nil
+}
+
+// Wait returns the value of k as soon as it exists. If the key does not exist yet, it waits for a Set of the key or
+// until ctx is done. Every Set of the key made through this Emerge wakes it up, also when events of Watch are dropped;
+// writes made to the driver by others are not seen.
+func (e *Emerge) Wait(ctx context.Context, k string) ([]byte, error) {
+	for {
+		e.m.Lock()
+		v, err := e.get(k)
+		if !errors.Is(err, os.ErrNotExist) {
+			e.m.Unlock()
+			return v, err
+		}
+		n, _ := e.key(k)
+		c := make(chan struct{})
+		if e.waits == nil {
+			e.waits = map[string][]chan struct{}{}
+		}
+		e.waits[n] = append(e.waits[n], c)
+		e.m.Unlock()
+		select {
+		case <-c:
+		case <-ctx.Done():
+			e.m.Lock()
+			l := e.waits[n]
+			for i := range l {
+				if l[i] == c {
+					e.waits[n] = append(l[:i:i], l[i+1:]...)
+					break
+				}
+			}
+			if len(e.waits[n]) == 0 {
+				delete(e.waits, n)
+			}
+			e.m.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Poll makes the Emerge notice changes made to the storage of the driver by others, e.g. files edited by another
+// process: every interval the driver looks for changed keys, drops them from its cache and an Event is sent to the
+// watchers, "set" for a changed key and "del" for a removed one. The driver must be a Poller, e.g. DocDriver or
+// MapDriver, otherwise ErrUnsupported will be returned. Polling costs a scan of the storage every interval, so it is
+// off unless started. It stops when the returned function is called or the Emerge is closed.
+func (e *Emerge) Poll(interval time.Duration) (func(), error) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	if e.closed {
+		return nil, ErrClosed
+	}
+	p, ok := e.driver.(Poller)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	stop := p.Poll(interval, func(k string, deleted bool) {
+		e.m.Lock()
+		defer e.m.Unlock()
+		if e.closed {
+			return
+		}
+		if deleted {
+			e.emit("del", k)
+		} else {
+			e.emit("set", k)
+		}
+	})
+	e.polls = append(e.polls, stop)
+	return stop, nil
+}
+
+// Do calls f with the driver under the lock, so f is serialized with all other operations. It is the way to call the
+// methods of a shared driver beyond Driver, e.g. VersionedDriver.Rollback. Writes made by f emit no events. If the
+// Emerge is closed, ErrClosed will be returned and f is not called.
+func (e *Emerge) Do(f func(d Driver) error) error {
+	e.m.Lock()
+	defer e.m.Unlock()
+	if e.closed {
+		return ErrClosed
+	}
+	return f(e.driver)
+}
+
+// Verify reads every key and returns the keys whose value can not be read, e.g. a file which is unreadable or a value
+// which fails the integrity check of an AesDriver with ErrCorrupt, so damage is found before a Get runs into it. Keys
+// deleted meanwhile are skipped. The driver must be a Lister, otherwise ErrUnsupported will be returned. Each key is
+// read under its own lock acquisition, so other operations proceed during the scan.
+func (e *Emerge) Verify() ([]string, error) {
+	l, err := e.Keys()
+	if err != nil {
+		return nil, err
+	}
+	r := []string{}
+	for _, k := range l {
+		e.m.Lock()
+		_, err := e.get(k)
+		e.m.Unlock()
+		if errors.Is(err, ErrClosed) {
+			return nil, err
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			r = append(r, k)
+		}
+	}
+	return r, nil
+}
+
+// Backup writes all keys and values to w as a tar archive, one file per key named by the key, which can be extracted
+// and loaded back with ImportDir. Writes are not blocked while the archive is written, and the consistency depends on
+// the driver. If the driver is a Snapshotter, e.g. MemDriver, its values are copied under a brief lock and the archive
+// is a point in time view of the store. Otherwise the driver must be a Lister: the keys are listed at a point in time
+// and every value is read under its own lock acquisition, so each value is intact but a value may be newer than the
+// listing, and keys deleted meanwhile are left out.
+func (e *Emerge) Backup(w io.Writer) error {
+	e.m.Lock()
+	var (
+		snap map[string][]byte
+		keys []string
+		err  error
+	)
+	if e.closed {
+		err = ErrClosed
+	} else if s, ok := e.driver.(Snapshotter); ok {
+		snap, err = s.Snapshot()
+		for k := range snap {
+			keys = append(keys, k)
+		}
+	} else if l, ok := e.driver.(Lister); ok {
+		keys, err = l.Keys()
+	} else {
+		err = ErrUnsupported
+	}
+	e.m.Unlock()
+	if err != nil {
+		return &OpError{Op: "backup", Err: err}
+	}
+	sort.Strings(keys)
+	t := tar.NewWriter(w)
+	now := time.Now()
+	for _, k := range keys {
+		v := snap[k]
+		if snap == nil {
+			e.m.Lock()
+			if e.closed {
+				err = &OpError{Op: "get", Key: k, Err: ErrClosed}
+			} else if IsSidecar(k) {
+				v, err = e.driver.Get(k)
+			} else {
+				v, err = e.get(k)
+			}
+			e.m.Unlock()
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if err := t.WriteHeader(&tar.Header{Name: k, Mode: 0644, Size: int64(len(v)), ModTime: now}); err != nil {
+			return err
+		}
+		if _, err := t.Write(v); err != nil {
+			return err
+		}
+	}
+	return t.Close()
+}
+
+// Close stops accepting operations, all later ones fail with ErrClosed. It waits for the running operation, delivers
+// the queued events and closes the channels of all watchers, and then closes the driver if it is an io.Closer, which
+// flushes its background work, e.g. the queue of a BackupDriver or the last snapshot of a persisted MemDriver. It
+// returns the error of closing the driver.
+func (e *Emerge) Close() error {
+	e.m.Lock()
+	defer e.m.Unlock()
+	if e.closed {
+		return ErrClosed
+	}
+	e.closed = true
+	for _, stop := range e.polls {
+		stop()
+	}
+	// Woken callers of Wait find the Emerge closed.
+	for k, l := range e.waits {
+		for _, c := range l {
+			close(c)
+		}
+		delete(e.waits, k)
+	}
+	if e.events != nil {
+		// The dispatcher delivers the queued events, then closes the channels of the watchers.
+		close(e.events)
+		<-e.done
+	}
+	if c, ok := e.driver.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
 }
 
 // Mem returns a concurrency-safety Client with MemDriver.
@@ -230,3 +4973,102 @@ func Lru(size int) Client { return NewEmerge(NewLruDriver(size)) }
 
 // Map returns a concurrency-safety Client with MapDriver.
 func Map(root string) Client { return NewEmerge(NewMapDriver(root)) }
+
+var (
+	registryMu sync.Mutex
+	registry   = map[string]func(dsn string) (Driver, error){}
+)
+
+// Register makes a driver available to Open under name, factory creates the driver from a data source name whose
+// meaning is up to the driver. Like database/sql, it panics if a driver is registered twice under the same name. The
+// built-in drivers are registered as "mem" (dsn is ignored), "doc" and "map" (dsn is the root directory) and "lru" (dsn
+// is the size).
+func Register(name string, factory func(dsn string) (Driver, error)) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, b := registry[name]; b {
+		panic("acdb: register driver twice: " + name)
+	}
+	registry[name] = factory
+}
+
+// Open returns a concurrency-safety Emerge with the driver registered under name.
+func Open(name string, dsn string) (*Emerge, error) {
+	registryMu.Lock()
+	factory, b := registry[name]
+	registryMu.Unlock()
+	if !b {
+		return nil, fmt.Errorf("acdb: unknown driver %q", name)
+	}
+	d, err := factory(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return NewEmerge(d), nil
+}
+
+// OpenDSN returns a concurrency-safety Emerge described by a url, the scheme names the registered driver. The built-in
+// drivers take:
+//
+//	mem://
+//	doc:///var/data, doc:data     the root directory, absolute or relative
+//	map:///var/data, map:data     the root directory, absolute or relative
+//	lru://?size=1024              the size
+//
+// For other drivers the whole url is passed to the factory as dsn.
+func OpenDSN(dsn string) (*Emerge, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("acdb: invalid dsn %q: %w", dsn, err)
+	}
+	if u.Scheme == "" {
+		return nil, fmt.Errorf("acdb: invalid dsn %q: missing driver", dsn)
+	}
+	root := u.Opaque
+	if root == "" {
+		root = u.Host + u.Path
+	}
+	switch u.Scheme {
+	case "mem":
+		if root != "" || u.RawQuery != "" {
+			return nil, fmt.Errorf("acdb: invalid dsn %q: mem takes no parameters", dsn)
+		}
+		return Open("mem", "")
+	case "doc", "map":
+		if root == "" || u.RawQuery != "" {
+			return nil, fmt.Errorf("acdb: invalid dsn %q: %s takes exactly a root directory", dsn, u.Scheme)
+		}
+		return Open(u.Scheme, root)
+	case "lru":
+		q := u.Query()
+		if root != "" || len(q) != 1 || q.Get("size") == "" {
+			return nil, fmt.Errorf("acdb: invalid dsn %q: lru takes exactly a size", dsn)
+		}
+		return Open("lru", q.Get("size"))
+	}
+	return Open(u.Scheme, dsn)
+}
+
+func init() {
+	Register("mem", func(dsn string) (Driver, error) { return NewMemDriver(), nil })
+	// The root is created here, so a failure is returned rather than panicking in NewDocDriver.
+	Register("doc", func(dsn string) (Driver, error) {
+		if err := os.MkdirAll(dsn, 0755); err != nil {
+			return nil, err
+		}
+		return NewDocDriver(dsn), nil
+	})
+	Register("lru", func(dsn string) (Driver, error) {
+		n, err := strconv.Atoi(dsn)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("acdb: invalid lru size %q", dsn)
+		}
+		return NewLruDriver(n), nil
+	})
+	Register("map", func(dsn string) (Driver, error) {
+		if err := os.MkdirAll(dsn, 0755); err != nil {
+			return nil, err
+		}
+		return NewMapDriver(dsn), nil
+	})
+}
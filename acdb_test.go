@@ -0,0 +1,1201 @@
+package acdb
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEmergeSwapRestore(t *testing.T) {
+	d := NewFaultDriver(NewMemDriver())
+	e := NewEmerge(d)
+	e.Set("a", []byte("1"))
+	e.Set("b", []byte("2"))
+	errDisk := errors.New("disk")
+	d.FailKey("set", "b", errDisk)
+	if err := e.Swap("a", "b"); !errors.Is(err, errDisk) {
+		t.Fatalf("swap: %v", err)
+	}
+	for k, want := range map[string]string{"a": "1", "b": "2"} {
+		v, err := e.Get(k)
+		if err != nil || string(v) != want {
+			t.Fatalf("get %s: %q, %v", k, v, err)
+		}
+	}
+}
+
+// failWriter fails every write and counts them.
+type failWriter struct {
+	n int
+}
+
+func (w *failWriter) Write(p []byte) (int, error) {
+	w.n++
+	return 0, io.ErrShortWrite
+}
+
+func TestMapDriverGetToFailedWrite(t *testing.T) {
+	d := NewMapDriver(t.TempDir())
+	d.Set("k", []byte("value"))
+	w := &failWriter{}
+	if _, err := d.GetTo("k", w); err != io.ErrShortWrite {
+		t.Fatalf("get to: %v", err)
+	}
+	if w.n != 1 {
+		t.Fatalf("written %d times", w.n)
+	}
+}
+
+// natsServer is a fake NATS server with a single JetStream key-value bucket, enough to test JetStreamDriver. It sends
+// a PING before every reply, which the client must answer.
+func natsServer(conn net.Conn, bucket string) {
+	r := bufio.NewReader(conn)
+	data := map[string][]byte{}
+	hdrs := map[string][]byte{}
+	reply := func(subject string, b []byte) {
+		fmt.Fprintf(conn, "PING\r\nMSG %s 1 %d\r\n%s\r\n", subject, len(b), b)
+	}
+	fmt.Fprintf(conn, "INFO {\"headers\":true}\r\n")
+	for {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		f := strings.Fields(l)
+		if len(f) == 0 || (f[0] != "PUB" && f[0] != "HPUB") {
+			if len(f) != 0 && f[0] == "PING" {
+				conn.Write([]byte("PONG\r\n"))
+			}
+			continue
+		}
+		n, _ := strconv.Atoi(f[len(f)-1])
+		h := 0
+		if f[0] == "HPUB" {
+			h, _ = strconv.Atoi(f[len(f)-2])
+		}
+		m := make([]byte, n+2)
+		io.ReadFull(r, m)
+		switch subject := f[1]; {
+		case subject == "$JS.API.STREAM.MSG.GET.KV_"+bucket:
+			q := struct {
+				Last string `json:"last_by_subj"`
+			}{}
+			json.Unmarshal(m[:n], &q)
+			v, ok := data[q.Last]
+			if !ok {
+				reply(f[2], []byte(`{"error":{"code":404,"err_code":10037,"description":"no message found"}}`))
+				continue
+			}
+			b, _ := json.Marshal(map[string]interface{}{"message": map[string]interface{}{"hdrs": hdrs[q.Last], "data": v}})
+			reply(f[2], b)
+		case strings.HasPrefix(subject, "$KV."+bucket+"."):
+			hdrs[subject] = append([]byte{}, m[:h]...)
+			data[subject] = append([]byte{}, m[h:n]...)
+			reply(f[2], []byte(`{"stream":"KV_`+bucket+`","seq":1}`))
+		default:
+			fmt.Fprintf(conn, "HMSG %s 1 16 16\r\nNATS/1.0 503\r\n\r\n\r\n", f[2])
+		}
+	}
+}
+
+func TestJetStreamDriver(t *testing.T) {
+	c, s := net.Pipe()
+	go natsServer(s, "b")
+	d, err := NewJetStreamDriver(c, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if _, err := d.Get("k"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("get missing: %v", err)
+	}
+	for _, v := range []string{"v", ""} {
+		if err := d.Set("k", []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := d.Get("k"); err != nil || string(b) != v {
+			t.Fatalf("get: %q, %v", b, err)
+		}
+	}
+	if err := d.Del("k"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get("k"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("get deleted: %v", err)
+	}
+	if err := d.Del("k"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("del deleted: %v", err)
+	}
+	if err := d.Set("a b", nil); err != ErrInvalidKey {
+		t.Fatalf("set invalid: %v", err)
+	}
+	d.bucket = "missing"
+	if _, err := d.Get("k"); err == nil || errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("get missing bucket: %v", err)
+	}
+}
+
+func TestNegativeCacheDriverBounded(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		if _, err := NewNegativeCacheDriver(NewMemDriver(), time.Hour, n); err == nil {
+			t.Fatalf("size %d accepted", n)
+		}
+	}
+	d, err := NewNegativeCacheDriver(NewMemDriver(), time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		d.Get(k)
+	}
+	if n := d.miss.order.Len(); n != 2 {
+		t.Fatalf("%d misses remembered", n)
+	}
+	d.driver.Set("c", []byte("v"))
+	if _, err := d.Get("c"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("get remembered miss: %v", err)
+	}
+	d.driver.Set("a", []byte("v"))
+	if v, err := d.Get("a"); err != nil || string(v) != "v" {
+		t.Fatalf("get forgotten miss: %q, %v", v, err)
+	}
+}
+
+func TestLruDriver(t *testing.T) {
+	d := NewLruDriver(2)
+	d.Set("a", []byte("1"))
+	d.Set("b", []byte("22"))
+	d.Get("a")
+	d.Set("c", []byte("333"))
+	if _, err := d.Get("b"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("least recently used kept: %v", err)
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, err := d.Get(k); err != nil {
+			t.Fatalf("get %s: %v", k, err)
+		}
+	}
+	select {
+	case e := <-d.Evictions():
+		if e.Key != "b" {
+			t.Fatalf("evicted %q", e.Key)
+		}
+	default:
+		t.Fatal("no eviction event")
+	}
+	if n := d.Bytes(); n != 6 {
+		t.Fatalf("bytes %d", n)
+	}
+	d.Set("a", []byte("11"))
+	if n := d.Bytes(); n != 7 {
+		t.Fatalf("bytes after overwrite %d", n)
+	}
+	d.Del("c")
+	if n := d.Bytes(); n != 3 {
+		t.Fatalf("bytes after del %d", n)
+	}
+}
+
+func TestNewLruDriverNoSize(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		d := NewLruDriver(n)
+		if err := d.Set("k", []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.Get("k"); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("size %d: get %v", n, err)
+		}
+		if b := d.Bytes(); b != 0 {
+			t.Fatalf("size %d: bytes %d", n, b)
+		}
+	}
+}
+
+func TestShardedLruDriverCapacity(t *testing.T) {
+	for _, c := range [][2]int{{2, 4}, {10, 4}, {16, 16}, {1000, 7}} {
+		d := NewShardedLruDriver(c[0], c[1])
+		n := 0
+		for _, s := range d.shards {
+			n += s.lru.size
+			if s.lru.size < 1 {
+				t.Fatalf("size %d, shards %d: empty shard", c[0], c[1])
+			}
+		}
+		if n != c[0] {
+			t.Fatalf("size %d, shards %d: capacity %d", c[0], c[1], n)
+		}
+		for i := 0; i < 4*c[0]; i++ {
+			d.Set(strconv.Itoa(i), nil)
+		}
+		n = 0
+		for i := 0; i < 4*c[0]; i++ {
+			if _, err := d.Get(strconv.Itoa(i)); err == nil {
+				n++
+			}
+		}
+		if n > c[0] {
+			t.Fatalf("size %d, shards %d: %d keys held", c[0], c[1], n)
+		}
+	}
+}
+
+func TestNewShardedLruDriverNoShards(t *testing.T) {
+	d := NewShardedLruDriver(4, 0)
+	d.Set("k", []byte("v"))
+	if v, err := d.Get("k"); err != nil || string(v) != "v" {
+		t.Fatalf("get: %q, %v", v, err)
+	}
+}
+
+func TestNewPartitionedMemDriverNoPartitions(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		d := NewPartitionedMemDriver(n)
+		d.Set("k", []byte("v"))
+		if v, err := d.Get("k"); err != nil || string(v) != "v" {
+			t.Fatalf("get: %q, %v", v, err)
+		}
+	}
+}
+
+// benchParallel runs a mix of one Set to three Gets over 2048 keys from GOMAXPROCS goroutines at once.
+func benchParallel(b *testing.B, d Driver) {
+	keys := make([]string, 2048)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	v := []byte("value")
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			k := keys[i%len(keys)]
+			if i%4 == 0 {
+				d.Set(k, v)
+			} else {
+				d.Get(k)
+			}
+		}
+	})
+}
+
+func BenchmarkLruDriverParallel(b *testing.B) {
+	benchParallel(b, NewEmerge(NewLruDriver(1024)))
+}
+
+func BenchmarkShardedLruDriverParallel(b *testing.B) {
+	benchParallel(b, NewShardedLruDriver(1024, 16))
+}
+
+func BenchmarkMemDriverParallel(b *testing.B) {
+	benchParallel(b, NewEmerge(NewMemDriver()))
+}
+
+func BenchmarkPartitionedMemDriverParallel(b *testing.B) {
+	benchParallel(b, NewPartitionedMemDriver(16))
+}
+
+func TestEmergeWaitUnderLoad(t *testing.T) {
+	e := NewEmerge(NewMemDriver())
+	// A watcher which never receives, so its buffer is full and events are dropped.
+	if _, _, err := e.Watch(); err != nil {
+		t.Fatal(err)
+	}
+	r := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := e.Wait(ctx, "k")
+		r <- err
+	}()
+	for i := 0; i < 10000; i++ {
+		e.Set(strconv.Itoa(i), nil)
+	}
+	e.Set("k", []byte("v"))
+	if err := <-r; err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := e.Wait(ctx, "missing"); err != context.Canceled {
+		t.Fatalf("wait canceled: %v", err)
+	}
+	if len(e.waits) != 0 {
+		t.Fatalf("%d keys waited for", len(e.waits))
+	}
+}
+
+func TestPromotingDriverCopiesUp(t *testing.T) {
+	slow := NewMemDriver()
+	d := NewPromotingDriver(NewMemDriver(), slow, 2, 1)
+	d.Set("k", []byte("v"))
+	d.Get("k")
+	d.Get("k")
+	if _, b := d.hot["k"]; !b {
+		t.Fatal("k not promoted")
+	}
+	// A new fast tier, as after a restart with a volatile one.
+	d = NewPromotingDriver(NewMemDriver(), slow, 2, 1)
+	if v, err := d.Get("k"); err != nil || string(v) != "v" {
+		t.Fatalf("get after restart: %q, %v", v, err)
+	}
+	for i := 0; i < 100; i++ {
+		k := strconv.Itoa(i)
+		d.Set(k, nil)
+		d.Get(k)
+	}
+	if len(d.count) > 16 {
+		t.Fatalf("%d keys counted", len(d.count))
+	}
+}
+
+func TestNewChunkDriverSize(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		if _, err := NewChunkDriver(NewMemDriver(), n); err == nil {
+			t.Fatalf("size %d accepted", n)
+		}
+	}
+}
+
+func TestChunkDriverPartialFailure(t *testing.T) {
+	f := NewFaultDriver(NewMemDriver())
+	d, _ := NewChunkDriver(f, 4)
+	if err := d.Set("k", []byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	errDisk := errors.New("disk")
+	f.FailKey("set", "k~c1.1", errDisk)
+	if err := d.Set("k", []byte("abcdefghij")); !errors.Is(err, errDisk) {
+		t.Fatalf("set: %v", err)
+	}
+	if v, err := d.Get("k"); err != nil || string(v) != "0123456789" {
+		t.Fatalf("get after failed set: %q, %v", v, err)
+	}
+	f.rules = nil
+	f.FailKey("set", "k", errDisk)
+	if err := d.Set("k", []byte("abcdefghij")); !errors.Is(err, errDisk) {
+		t.Fatalf("set manifest: %v", err)
+	}
+	if v, err := d.Get("k"); err != nil || string(v) != "0123456789" {
+		t.Fatalf("get after failed manifest: %q, %v", v, err)
+	}
+	f.rules = nil
+	if err := d.Set("k", []byte("abcde")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.Get("k"); err != nil || string(v) != "abcde" {
+		t.Fatalf("get: %q, %v", v, err)
+	}
+	if err := d.Del("k"); err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := f.driver.(Lister).Keys(); len(l) != 0 {
+		t.Fatalf("keys left: %q", l)
+	}
+}
+
+func TestNewRollingCounterGranularity(t *testing.T) {
+	for _, g := range []time.Duration{0, -time.Second} {
+		if _, err := NewRollingCounter(NewMemDriver(), g, time.Hour); err == nil {
+			t.Fatalf("granularity %s accepted", g)
+		}
+	}
+}
+
+func TestEmergeKeysPageLimit(t *testing.T) {
+	e := NewEmerge(NewMemDriver())
+	e.Set("k", nil)
+	for _, n := range []int{0, -1} {
+		if _, _, err := e.KeysPage("", n); err == nil {
+			t.Fatalf("limit %d accepted", n)
+		}
+	}
+}
+
+func TestOpenBadRoot(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(f, nil, 0644)
+	for _, name := range []string{"doc", "map"} {
+		if _, err := Open(name, filepath.Join(f, "root")); err == nil {
+			t.Fatalf("%s: root under a file accepted", name)
+		}
+	}
+}
+
+// next returns the next event of c, or fails the test after a second.
+func next(t *testing.T, c <-chan Event) Event {
+	t.Helper()
+	select {
+	case ev := <-c:
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+	return Event{}
+}
+
+func TestEmergePoll(t *testing.T) {
+	root := t.TempDir()
+	e := NewEmerge(NewMapDriver(root))
+	defer e.Close()
+	if _, err := e.Poll(10 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	c, _, _ := e.Watch()
+	e.Set("k", []byte("v"))
+	if ev := next(t, c); ev != (Event{"set", "k"}) {
+		t.Fatalf("event %v", ev)
+	}
+	// The write through the driver is not reported again.
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case ev := <-c:
+		t.Fatalf("event %v", ev)
+	default:
+	}
+	os.WriteFile(filepath.Join(root, "k"), []byte("changed"), 0644)
+	if ev := next(t, c); ev != (Event{"set", "k"}) {
+		t.Fatalf("event %v", ev)
+	}
+	if v, err := e.Get("k"); err != nil || string(v) != "changed" {
+		t.Fatalf("get: %q, %v", v, err)
+	}
+	os.Remove(filepath.Join(root, "k"))
+	if ev := next(t, c); ev != (Event{"del", "k"}) {
+		t.Fatalf("event %v", ev)
+	}
+	if _, err := e.Get("k"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("get removed: %v", err)
+	}
+	if _, err := NewEmerge(NewMemDriver()).Poll(time.Second); err != ErrUnsupported {
+		t.Fatalf("poll mem: %v", err)
+	}
+}
+
+// TestStress runs overlapping operations on the drivers from many goroutines at once, it is meant for the race
+// detector: go test -race -run Stress.
+func TestStress(t *testing.T) {
+	index, _ := NewIndexDriver(NewMemDriver(), "a")
+	count := NewCountDriver(NewMemDriver())
+	versioned := NewVersionedDriver(NewMemDriver(), 2)
+	m := NewMapDriver(t.TempDir())
+	chunk, _ := NewChunkDriver(NewMemDriver(), 4)
+	// Extra methods which are safe by themselves are called directly, the others through Do.
+	extra := map[Driver]func(e *Emerge, k string){
+		index: func(e *Emerge, k string) { index.FindBy("a", k) },
+		count: func(e *Emerge, k string) { count.AccessCount(k) },
+		m: func(e *Emerge, k string) {
+			m.Invalidate(k)
+			m.CacheStats()
+			e.Do(func(Driver) error { return m.Warm([]string{k}) })
+		},
+		versioned: func(e *Emerge, k string) {
+			e.Do(func(Driver) error { return versioned.Rollback(k) })
+			e.Do(func(Driver) error { _, err := versioned.GetVersion(k, 1); return err })
+		},
+	}
+	drivers := []Driver{
+		NewMemDriver(),
+		NewLruDriver(4),
+		NewDocDriver(t.TempDir()),
+		index,
+		count,
+		versioned,
+		m,
+		chunk,
+		NewTimeoutDriver(NewShardedLruDriver(4, 2), time.Second),
+	}
+	for _, d := range drivers {
+		e := NewEmerge(d)
+		f := extra[d]
+		stress(func(i int, k string) {
+			switch i % 4 {
+			case 0:
+				e.Set(k, []byte(`{"a":"`+k+`"}`))
+			case 1:
+				e.Del(k)
+			default:
+				e.Get(k)
+			}
+			if f != nil {
+				f(e, k)
+			}
+		})
+	}
+	for _, d := range []Driver{NewShardedLruDriver(4, 2), NewPartitionedMemDriver(2)} {
+		stress(func(i int, k string) {
+			switch i % 4 {
+			case 0:
+				d.Set(k, []byte(k))
+			case 1:
+				d.Del(k)
+			default:
+				d.Get(k)
+			}
+		})
+	}
+}
+
+// stress calls f from 8 goroutines, 200 times each, with keys out of a small set so they overlap.
+func stress(f func(i int, k string)) {
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				f(g+i, strconv.Itoa(i%8))
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestNewAesDriverSecret(t *testing.T) {
+	for _, n := range []int{0, 15, 33, 64} {
+		if _, err := NewAesDriver(NewMemDriver(), make([]byte, n), false); err == nil {
+			t.Fatalf("secret of %d bytes accepted", n)
+		}
+	}
+	for _, n := range []int{16, 24, 32} {
+		if _, err := NewAesDriver(NewMemDriver(), make([]byte, n), false); err != nil {
+			t.Fatalf("secret of %d bytes: %v", n, err)
+		}
+	}
+}
+
+func TestMapDriverCacheFailure(t *testing.T) {
+	d := NewMapDriver(t.TempDir())
+	d.Set("k", []byte("old"))
+	lru := NewFaultDriver(d.lru)
+	d.lru = lru
+	errCache := errors.New("cache")
+	lru.FailKey("set", "k", errCache)
+	if err := d.Set("k", []byte("new")); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if v, err := d.Get("k"); err != nil || string(v) != "new" {
+		t.Fatalf("get: %q, %v", v, err)
+	}
+	lru.FailKey("get", "k", errCache)
+	lru.FailKey("del", "k", errCache)
+	if v, err := d.Get("k"); err != nil || string(v) != "new" {
+		t.Fatalf("get: %q, %v", v, err)
+	}
+	if err := d.Del("k"); err != nil {
+		t.Fatalf("del: %v", err)
+	}
+	if _, err := d.doc.Get("k"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("file kept: %v", err)
+	}
+}
+
+func TestMemDriverPersistedStale(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "snapshot")
+	d := NewMemDriverPersisted(name, time.Hour)
+	d.Set("k", []byte("v"))
+	d.Close()
+	e := NewEmerge(NewMemDriverPersisted(name, time.Hour))
+	defer e.Close()
+	if _, err := e.GetFresh("k", time.Hour); !errors.Is(err, ErrStale) {
+		t.Fatalf("get fresh: %v", err)
+	}
+	if v, err := e.Get("k"); err != nil || string(v) != "v" {
+		t.Fatalf("get: %q, %v", v, err)
+	}
+}
+
+// BenchmarkDrivers measures a Set and a Get of a small value on every local driver.
+func BenchmarkDrivers(b *testing.B) {
+	drivers := []struct {
+		name string
+		new  func(root string) Driver
+	}{
+		{"Mem", func(string) Driver { return NewMemDriver() }},
+		{"Lru", func(string) Driver { return NewLruDriver(1024) }},
+		{"SampledLru", func(string) Driver { return NewSampledLruDriver(1024, 5) }},
+		{"Doc", func(root string) Driver { return NewDocDriver(root) }},
+		{"Map", func(root string) Driver { return NewMapDriver(root) }},
+	}
+	v := []byte("value")
+	for _, c := range drivers {
+		d := c.new(b.TempDir())
+		b.Run(c.name+"/Set", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				d.Set("k", v)
+			}
+		})
+		b.Run(c.name+"/Get", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				d.Get("k")
+			}
+		})
+	}
+}
+
+// BenchmarkMapDriverGetMiss cycles through more keys than the cache holds, so every Get reads the disk and fills the
+// cache.
+func BenchmarkMapDriverGetMiss(b *testing.B) {
+	d := NewMapDriver(b.TempDir())
+	keys := make([]string, 2*d.size)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+		d.Set(keys[i], []byte("value"))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.Get(keys[i%len(keys)])
+	}
+}
+
+func TestNotExistThroughWrappers(t *testing.T) {
+	wrappers := []struct {
+		name string
+		wrap func(d Driver) (Driver, error)
+	}{
+		// BloomDriver needs a Lister, so it goes right above the MemDriver.
+		{"Bloom", func(d Driver) (Driver, error) { return NewBloomDriver(d, 64, 0.01) }},
+		{"Compress", func(d Driver) (Driver, error) { return NewCompressDriver(d, 0), nil }},
+		{"Aes", func(d Driver) (Driver, error) { return NewAesDriver(d, make([]byte, 32), true) }},
+		{"Chunk", func(d Driver) (Driver, error) { return NewChunkDriver(d, 4) }},
+		{"Versioned", func(d Driver) (Driver, error) { return NewVersionedDriver(d, 2), nil }},
+		{"Expire", func(d Driver) (Driver, error) { return NewExpireDriver(d), nil }},
+		{"Index", func(d Driver) (Driver, error) { return NewIndexDriver(d, "a") }},
+		{"Count", func(d Driver) (Driver, error) { return NewCountDriver(d), nil }},
+		{"Latency", func(d Driver) (Driver, error) { return NewLatencyDriver(d), nil }},
+		{"Dedupe", func(d Driver) (Driver, error) { return NewDedupeDriver(d), nil }},
+		{"Validate", func(d Driver) (Driver, error) {
+			return NewValidateDriver(d, func(string, []byte) error { return nil }), nil
+		}},
+		{"Defaults", func(d Driver) (Driver, error) { return NewDefaultsDriver(d, nil), nil }},
+		{"Protect", func(d Driver) (Driver, error) {
+			return NewProtectDriver(d, func(string) bool { return false }), nil
+		}},
+		{"Overlay", func(d Driver) (Driver, error) { return NewOverlayDriver(NewMemDriver(), d), nil }},
+		{"Migrate", func(d Driver) (Driver, error) { return NewMigrateDriver(d, NewMemDriver()), nil }},
+		{"Backup", func(d Driver) (Driver, error) { return NewBackupDriver(d, NewMemDriver()), nil }},
+		{"NegativeCache", func(d Driver) (Driver, error) { return NewNegativeCacheDriver(d, time.Hour, 8) }},
+		{"Timeout", func(d Driver) (Driver, error) { return NewTimeoutDriver(d, time.Second), nil }},
+		{"Fault", func(d Driver) (Driver, error) { return NewFaultDriver(d), nil }},
+	}
+	var d Driver = NewMemDriver()
+	for _, w := range wrappers {
+		var err error
+		if d, err = w.wrap(d); err != nil {
+			t.Fatalf("%s: %v", w.name, err)
+		}
+		e := NewEmerge(d)
+		if _, err := e.Get("k"); !IsNotExist(err) {
+			t.Fatalf("%s: get: %v", w.name, err)
+		}
+		if err := e.Del("k"); !IsNotExist(err) {
+			t.Fatalf("%s: del: %v", w.name, err)
+		}
+		// A deleted key passes the bloom filter and misses in the MemDriver itself.
+		e.Set(w.name, []byte("v"))
+		e.Del(w.name)
+		if _, err := e.Get(w.name); !IsNotExist(err) {
+			t.Fatalf("%s: get deleted: %v", w.name, err)
+		}
+	}
+}
+
+// benchCache reads keys drawn from a zipf distribution over 4 times as many keys as d holds, and sets every key
+// missed, like a cache in front of a slow store. The hit rate is reported next to the time.
+func benchCache(b *testing.B, d Driver) {
+	z := rand.NewZipf(rand.New(rand.NewSource(1)), 1.1, 1, 4095)
+	keys := make([]string, 1<<16)
+	for i := range keys {
+		keys[i] = strconv.FormatUint(z.Uint64(), 10)
+	}
+	v := []byte("value")
+	hits := 0
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		k := keys[i%len(keys)]
+		if _, err := d.Get(k); err == nil {
+			hits++
+		} else {
+			d.Set(k, v)
+		}
+	}
+	b.ReportMetric(float64(hits)/float64(b.N), "hits/op")
+}
+
+func BenchmarkLruDriverCache(b *testing.B) {
+	benchCache(b, NewLruDriver(1024))
+}
+
+func BenchmarkSampledLruDriverCache(b *testing.B) {
+	benchCache(b, NewSampledLruDriver(1024, 5))
+}
+
+func TestListPopDel(t *testing.T) {
+	d := NewMemDriver()
+	l := NewList(d, 0)
+	for _, v := range []string{"a", "b"} {
+		l.LPush("q", []byte(v))
+	}
+	if v, err := l.LPop("q"); err != nil || string(v) != "b" {
+		t.Fatalf("pop: %q, %v", v, err)
+	}
+	if v, err := l.LPop("q"); err != nil || string(v) != "a" {
+		t.Fatalf("pop: %q, %v", v, err)
+	}
+	if _, err := l.LPop("q"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("pop empty: %v", err)
+	}
+	if len(d.data) != 0 {
+		t.Fatalf("%d keys left after pop", len(d.data))
+	}
+	for _, v := range []string{"a", "b", "c"} {
+		l.LPush("q", []byte(v))
+	}
+	if err := l.Del("q"); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.data) != 0 {
+		t.Fatalf("%d keys left after del", len(d.data))
+	}
+	if err := l.Del("q"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("del deleted: %v", err)
+	}
+}
+
+// gateDriver blocks every Set until the gate is closed.
+type gateDriver struct {
+	Driver
+	gate chan struct{}
+}
+
+func (d *gateDriver) Set(k string, v []byte) error {
+	<-d.gate
+	return d.Driver.Set(k, v)
+}
+
+func TestBackupDriverRepairsYield(t *testing.T) {
+	backup := &gateDriver{NewMemDriver(), make(chan struct{})}
+	d := NewBackupDriver(NewMemDriver(), backup)
+	d.SetReadRepair(true)
+	// The first write blocks the background goroutine, the others wait in the queue among the repairs.
+	d.Set("k", []byte("v"))
+	for len(d.queue) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 4096; i++ {
+		d.Get("k")
+		d.Get("missing")
+	}
+	for i := 0; i < cap(d.queue); i++ {
+		d.Set(strconv.Itoa(i), []byte("v"))
+	}
+	if n := d.Failures(); n != 0 {
+		t.Fatalf("%d writes skipped", n)
+	}
+	close(backup.gate)
+	d.Close()
+	for i := 0; i < cap(d.queue); i++ {
+		if _, err := backup.Get(strconv.Itoa(i)); err != nil {
+			t.Fatalf("get %d: %v", i, err)
+		}
+	}
+}
+
+func TestEmergeSetEncodeFailureKeepsValue(t *testing.T) {
+	e := NewEmerge(NewMemDriver())
+	e.SetEncode("k", map[string]int{"a": 1})
+	c, _, _ := e.Watch()
+	if err := e.SetEncode("k", map[string]interface{}{"a": make(chan int)}); err == nil {
+		t.Fatal("channel encoded")
+	}
+	e.SetEncodeErrorHandler(func(k string, v interface{}, err error) (interface{}, error) {
+		return nil, err
+	})
+	if err := e.SetEncode("k", func() {}); err == nil {
+		t.Fatal("func encoded")
+	}
+	v := map[string]int{}
+	if err := e.GetDecode("k", &v); err != nil || v["a"] != 1 {
+		t.Fatalf("get: %v, %v", v, err)
+	}
+	select {
+	case ev := <-c:
+		t.Fatalf("event %v", ev)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestEmergeStrictSidecars(t *testing.T) {
+	e := NewEmergeStrict(NewMemDriver(), false)
+	now := time.Now()
+	if err := e.SetTimestamped("k", []byte("1"), now); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetTimestamped("k", []byte("2"), now.Add(time.Second)); !errors.Is(err, ErrOverwrite) {
+		t.Fatalf("set timestamped again: %v", err)
+	}
+	e.Del("k")
+	if err := e.SetTimestamped("k", []byte("3"), now.Add(2*time.Second)); err != nil {
+		t.Fatalf("set timestamped after del: %v", err)
+	}
+	e = NewEmergeStrict(NewExpireDriver(NewMemDriver()), false)
+	if err := e.SetExpire("k", nil, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetExpire("k", nil, time.Hour); !errors.Is(err, ErrOverwrite) {
+		t.Fatalf("set expire again: %v", err)
+	}
+	if err := e.Set("k", nil); !errors.Is(err, ErrOverwrite) {
+		t.Fatalf("set after set expire: %v", err)
+	}
+}
+
+// benchDecode decodes a json object of DocDriver in a loop with get.
+func benchDecode(b *testing.B, get func(e *Emerge, v interface{}) error) {
+	e := NewEmerge(NewDocDriver(b.TempDir()))
+	e.SetEncode("k", map[string]string{"name": strings.Repeat("v", 1024)})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		v := struct {
+			Name string `json:"name"`
+		}{}
+		if err := get(e, &v); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetDecode(b *testing.B) {
+	benchDecode(b, func(e *Emerge, v interface{}) error {
+		return e.GetDecode("k", v)
+	})
+}
+
+func BenchmarkGetDecodeBuffer(b *testing.B) {
+	pool := sync.Pool{New: func() interface{} { return &bytes.Buffer{} }}
+	benchDecode(b, func(e *Emerge, v interface{}) error {
+		buf := pool.Get().(*bytes.Buffer)
+		defer pool.Put(buf)
+		return e.GetDecodeBuffer("k", v, buf)
+	})
+}
+
+func TestMapDriverDiskFull(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full")
+	}
+	root := t.TempDir()
+	d := NewMapDriver(root)
+	d.Set("k", []byte("old"))
+	// Writes of k land in /dev/full, which fails them with ENOSPC.
+	os.Remove(filepath.Join(root, "k"))
+	if err := os.Symlink("/dev/full", filepath.Join(root, "k")); err != nil {
+		t.Skip(err)
+	}
+	if err := d.Set("k", []byte("new")); !errors.Is(err, ErrDiskFull) {
+		t.Fatalf("set: %v", err)
+	}
+	if v, err := d.Get("k"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("get: %q, %v", v, err)
+	}
+}
+
+func TestMapDriverValuesNotAliased(t *testing.T) {
+	d := NewMapDriver(t.TempDir())
+	v := []byte("value")
+	d.Set("k", v)
+	v[0] = 'X'
+	d.doc.Set("d", []byte("value"))
+	// The first Get of d reads the disk and fills the cache.
+	b, _, err := d.GetCached("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[0] = 'X'
+	for _, k := range []string{"k", "d"} {
+		b, cached, err := d.GetCached(k)
+		if err != nil || !cached || string(b) != "value" {
+			t.Fatalf("get %s: %q, %v, %v", k, b, cached, err)
+		}
+	}
+}
+
+func TestSpillingLruDriverSpillFailure(t *testing.T) {
+	spill := NewFaultDriver(NewMemDriver())
+	d := NewSpillingLruDriver(1, spill)
+	d.Set("a", []byte("1"))
+	d.Set("b", []byte("2"))
+	if v, err := d.Get("a"); err != nil || string(v) != "1" {
+		t.Fatalf("get spilled a: %q, %v", v, err)
+	}
+	d.Del("b")
+	errSpill := errors.New("spill")
+	spill.FailKey("set", "a", errSpill)
+	if err := d.Set("b", []byte("2")); !errors.Is(err, errSpill) {
+		t.Fatalf("set: %v", err)
+	}
+	if v, err := d.Get("a"); err != nil || string(v) != "1" {
+		t.Fatalf("get a: %q, %v", v, err)
+	}
+	// b is in the spill driver only, and promoting it needs a to spill, which fails: the Get succeeds anyway.
+	spill.driver.Set("b", []byte("2"))
+	if v, err := d.Get("b"); err != nil || string(v) != "2" {
+		t.Fatalf("get b: %q, %v", v, err)
+	}
+	if v, err := d.Get("a"); err != nil || string(v) != "1" {
+		t.Fatalf("get a: %q, %v", v, err)
+	}
+}
+
+// benchSmall sets and gets a small value through Emerge in a loop.
+func benchSmall(b *testing.B, d *MemDriver) {
+	e := NewEmerge(d)
+	v := []byte("v")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		e.Set("k", v)
+		e.Get("k")
+	}
+}
+
+func BenchmarkMemDriverSmall(b *testing.B) {
+	benchSmall(b, NewMemDriver())
+}
+
+func BenchmarkMemDriverUntimedSmall(b *testing.B) {
+	benchSmall(b, NewMemDriverUntimed())
+}
+
+func TestEmergeSetTimestamped(t *testing.T) {
+	d := NewFaultDriver(NewMemDriver())
+	e := NewEmerge(d)
+	now := time.Now()
+	if err := e.SetTimestamped("k", []byte("1"), now); err != nil {
+		t.Fatal(err)
+	}
+	err := e.SetTimestamped("k", []byte("0"), now.Add(-time.Second))
+	var o *OpError
+	if !errors.Is(err, ErrOutdated) || !errors.As(err, &o) || o.Key != "k" {
+		t.Fatalf("set outdated: %v", err)
+	}
+	// A failed write of the value keeps the old timestamp, so a write between the two is still accepted.
+	errDisk := errors.New("disk")
+	d.FailKey("set", "k", errDisk)
+	if err := e.SetTimestamped("k", []byte("3"), now.Add(3*time.Second)); !errors.Is(err, errDisk) {
+		t.Fatalf("set failed: %v", err)
+	}
+	d.rules = nil
+	if err := e.SetTimestamped("k", []byte("2"), now.Add(2*time.Second)); err != nil {
+		t.Fatalf("set after failure: %v", err)
+	}
+	if v, err := e.Get("k"); err != nil || string(v) != "2" {
+		t.Fatalf("get: %q, %v", v, err)
+	}
+	if l, err := NewEmerge(d.driver).Keys(); err != nil || len(l) != 1 || l[0] != "k" {
+		t.Fatalf("keys: %q, %v", l, err)
+	}
+	for _, err := range []error{e.Set("k~ts", nil), e.Del("k~ts")} {
+		if !errors.Is(err, ErrInvalidKey) {
+			t.Fatalf("sidecar written: %v", err)
+		}
+	}
+	e.SetMaxKeyLen(4)
+	if err := e.SetTimestamped("kk", nil, now.Add(4*time.Second)); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("set with a long sidecar: %v", err)
+	}
+	if _, err := e.Get("kk"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("value of a long sidecar written: %v", err)
+	}
+}
+
+func TestEmergeBackupSidecars(t *testing.T) {
+	e := NewEmerge(NewDocDriver(t.TempDir()))
+	e.SetTimestamped("k", []byte("v"), time.Now())
+	buf := &bytes.Buffer{}
+	if err := e.Backup(buf); err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	r := tar.NewReader(buf)
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		b, _ := io.ReadAll(r)
+		os.WriteFile(filepath.Join(root, h.Name), b, 0644)
+	}
+	f := NewEmerge(NewMemDriver())
+	if n, err := f.ImportDir(root, nil); err != nil || n != 2 {
+		t.Fatalf("import: %d, %v", n, err)
+	}
+	if err := f.SetTimestamped("k", nil, time.Now().Add(-time.Hour)); !errors.Is(err, ErrOutdated) {
+		t.Fatalf("set outdated after import: %v", err)
+	}
+}
+
+func TestEmergeSetMeta(t *testing.T) {
+	d := NewFaultDriver(NewMemDriver())
+	e := NewEmerge(d)
+	if err := e.SetMeta("k", []byte("1"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	errDisk := errors.New("disk")
+	d.FailKey("set", "k", errDisk)
+	if err := e.SetMeta("k", []byte("2"), []byte("b")); !errors.Is(err, errDisk) {
+		t.Fatalf("set failed: %v", err)
+	}
+	d.rules = nil
+	r, m, err := e.OpenMeta("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := io.ReadAll(r); string(v) != "1" || string(m) != "a" {
+		t.Fatalf("open: %q, %q", v, m)
+	}
+	e.SetMeta("k", []byte("3"), nil)
+	if _, m, _ := e.OpenMeta("k"); m != nil {
+		t.Fatalf("meta not deleted: %q", m)
+	}
+	e.SetMeta("k", []byte("4"), []byte("c"))
+	e.Del("k")
+	if _, err := d.driver.Get("k~meta"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("meta kept on del: %v", err)
+	}
+}
+
+// etcdFake serves the range, put and deleterange calls of the etcd v3 JSON gateway from a map, and remembers the
+// range_end of the last range.
+type etcdFake struct {
+	kv  map[string][]byte
+	end []byte
+}
+
+func (f *etcdFake) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req := map[string]interface{}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	field := func(n string) []byte {
+		s, _ := req[n].(string)
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			panic(err)
+		}
+		return b
+	}
+	k, v, end := string(field("key")), field("value"), field("range_end")
+	// The keys from k to end, or k alone without end. An end of "\x00" means all keys from k.
+	match := func() []string {
+		l := []string{}
+		for e := range f.kv {
+			if len(end) == 0 && e == k || len(end) != 0 && e >= k && (string(end) == "\x00" || e < string(end)) {
+				l = append(l, e)
+			}
+		}
+		sort.Strings(l)
+		return l
+	}
+	res := map[string]interface{}{}
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		f.end = end
+		kvs := []map[string][]byte{}
+		for _, e := range match() {
+			kv := map[string][]byte{"key": []byte(e)}
+			// The gateway omits empty fields, an empty value included.
+			if keysOnly, _ := req["keys_only"].(bool); !keysOnly && len(f.kv[e]) != 0 {
+				kv["value"] = f.kv[e]
+			}
+			kvs = append(kvs, kv)
+		}
+		if len(kvs) != 0 {
+			res["kvs"] = kvs
+		}
+	case "/v3/kv/put":
+		f.kv[k] = v
+	case "/v3/kv/deleterange":
+		l := match()
+		for _, e := range l {
+			delete(f.kv, e)
+		}
+		if len(l) != 0 {
+			res["deleted"] = strconv.Itoa(len(l))
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func TestEtcdDriver(t *testing.T) {
+	f := &etcdFake{kv: map[string][]byte{"q": []byte("outside")}}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	d := NewEtcdDriver([]string{srv.URL + "/"}, "p/")
+	for k, v := range map[string]string{"a": "1", "k\x00\xff": "2", "empty": ""} {
+		if err := d.Set(k, []byte(v)); err != nil {
+			t.Fatalf("set %q: %v", k, err)
+		}
+		if b, err := d.Get(k); err != nil || b == nil || string(b) != v {
+			t.Fatalf("get %q: %q, %v", k, b, err)
+		}
+	}
+	if _, ok := f.kv["p/k\x00\xff"]; !ok {
+		t.Fatalf("binary key not stored: %q", f.kv)
+	}
+	if _, err := d.Get("none"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("get missing: %v", err)
+	}
+	l, err := d.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(l, ",") != "a,empty,k\x00\xff" || string(f.end) != "p0" {
+		t.Fatalf("keys: %q, range end %q", l, f.end)
+	}
+	if err := d.Del("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Del("a"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("del missing: %v", err)
+	}
+
+	l, _ = NewEtcdDriver([]string{srv.URL}, "").Keys()
+	if strings.Join(l, ",") != "p/empty,p/k\x00\xff,q" || string(f.end) != "\x00" {
+		t.Fatalf("keys of empty prefix: %q, range end %q", l, f.end)
+	}
+	f.kv = map[string][]byte{"a\xfe": nil, "a\xffx": nil, "b": nil}
+	l, _ = NewEtcdDriver([]string{srv.URL}, "a\xff").Keys()
+	if strings.Join(l, ",") != "x" || string(f.end) != "b" {
+		t.Fatalf("keys of 0xff prefix: %q, range end %q", l, f.end)
+	}
+	f.kv = map[string][]byte{"\xfe": nil, "\xff\xffx": nil}
+	l, _ = NewEtcdDriver([]string{srv.URL}, "\xff\xff").Keys()
+	if strings.Join(l, ",") != "x" || string(f.end) != "\x00" {
+		t.Fatalf("keys of all 0xff prefix: %q, range end %q", l, f.end)
+	}
+}
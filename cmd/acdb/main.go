@@ -1,62 +1,468 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/mohanson/acdb"
-	"github.com/mohanson/doa"
 )
 
 var (
-	flListen = flag.String("l", "127.0.0.1:8080", "listen address")
-	flRoot   = flag.String("d", ".", "root directory")
-	client   acdb.Client
+	flListen        = flag.String("l", "127.0.0.1:8080", "listen address")
+	flRoot          = flag.String("d", ".", "root directory")
+	flDriver        = flag.String("driver", "map", "driver registered in acdb, e.g. mem, doc, lru and map")
+	flDsn           = flag.String("dsn", "", "data source name of the driver, defaults to -d or -lru-size")
+	flLruSize       = flag.Int("lru-size", 1024, "size of the lru driver")
+	flAccess        = flag.Bool("access-log", false, "log every request with its status, response size and duration")
+	flMaxConcurrent = flag.Int("max-concurrent", 0, "maximum number of requests served at once, 0 means unlimited")
+	flCorsOrigin    = flag.String("cors-origin", "", "comma separated CORS origins, * allows any")
+	flCorsMethods   = flag.String("cors-methods", "GET, PUT, DELETE", "methods allowed by CORS")
+	flCorsHeaders   = flag.String("cors-headers", "Content-Type", "request headers allowed by CORS")
+	flJSON          = flag.Bool("json", false, "reject values which are not valid json")
+	flPretty        = flag.Bool("pretty", false, "indent json values on GET, as ?pretty=1 does per request")
+	flVerify        = flag.Bool("verify", false, "print the keys whose value can not be read and exit")
+	client          *acdb.Emerge
+	hooks           []Hook
 )
 
+// Hook inspects or transforms values passing through the server. OnSet runs on every PUT before the value is stored,
+// it may rewrite the value, or reject it with an error which is answered with 422 Unprocessable Entity. OnGet runs on
+// every GET before the value is sent, an error is answered with 500 Internal Server Error. Hooks run in the order they
+// are registered, each one receiving the output of the previous one.
+type Hook interface {
+	OnSet(k string, v []byte) ([]byte, error)
+	OnGet(k string, v []byte) ([]byte, error)
+}
+
+// JSONHook rejects values which are not valid json.
+type JSONHook struct{}
+
+func (JSONHook) OnSet(k string, v []byte) ([]byte, error) {
+	if !json.Valid(v) {
+		return nil, errors.New("main: value is not valid json")
+	}
+	return v, nil
+}
+
+func (JSONHook) OnGet(k string, v []byte) ([]byte, error) {
+	return v, nil
+}
+
+// key returns the key addressed by the escaped url path p. The path is cleaned like path.Clean, so duplicate slashes
+// are collapsed, "." and ".." are resolved without escaping the root, and the leading and trailing slashes are removed.
+// For example "/foo", "foo/", "//foo" and "/bar/../foo" all name the key "foo". The root path names no key and results
+// in an empty string.
+func key(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// meta is the metadata of a value, stored beside it with SetMeta so both are written at once: the Content-Type and
+// Content-Encoding of the PUT which stored the value.
+type meta struct {
+	Type     string `json:"type,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// encode returns the stored form of m, nil if m is empty so nothing is stored.
+func (m meta) encode() []byte {
+	if m == (meta{}) {
+		return nil
+	}
+	b, _ := json.Marshal(m)
+	return b
+}
+
+// decodeMeta returns the metadata stored as b. Metadata which does not decode is ignored.
+func decodeMeta(b []byte) meta {
+	m := meta{}
+	json.Unmarshal(b, &m)
+	return m
+}
+
+// acceptsGzip reports whether the Accept-Encoding header of r allows a gzip encoded response.
+func acceptsGzip(r *http.Request) bool {
+	for _, e := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		l := strings.Split(e, ";")
+		if n := strings.TrimSpace(l[0]); n != "gzip" && n != "*" {
+			continue
+		}
+		if len(l) == 1 || strings.ReplaceAll(l[1], " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
+func gunzip(b []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// status returns the http status code of a failed operation: 404 if the key does not exist, 400 if the key is invalid,
+// 413 if the value is too large for the driver, 500 otherwise.
+func status(err error) int {
+	switch {
+	case acdb.IsNotExist(err):
+		return http.StatusNotFound
+	case errors.Is(err, acdb.ErrInvalidKey):
+		return http.StatusBadRequest
+	case errors.Is(err, acdb.ErrTooLarge):
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+// errInvalidQuery is returned by list for a query with an invalid limit or cursor.
+var errInvalidQuery = errors.New("main: invalid limit or cursor")
+
+// list returns the keys requested by the query. Without a limit all keys are returned, otherwise a page of at most
+// limit keys starting after cursor, and the cursor of the next page.
+func list(q url.Values) ([]string, string, error) {
+	if q.Get("limit") == "" {
+		l, err := client.KeysSorted()
+		return l, "", err
+	}
+	n, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || n <= 0 {
+		return nil, "", errInvalidQuery
+	}
+	l, next, err := client.KeysPage(q.Get("cursor"), n)
+	if errors.Is(err, acdb.ErrInvalidKey) {
+		return nil, "", errInvalidQuery
+	}
+	return l, next, err
+}
+
 func hand(w http.ResponseWriter, r *http.Request) {
-	k := r.URL.EscapedPath()
-	if k == "/" {
+	k := key(r.URL.EscapedPath())
+	if k == "" && r.Method == http.MethodGet {
+		l, next, err := list(r.URL.Query())
+		if errors.Is(err, acdb.ErrUnsupported) {
+			w.WriteHeader(http.StatusNotImplemented)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if errors.Is(err, errInvalidQuery) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if next != "" {
+			w.Header().Set("X-Acdb-Next", next)
+		}
+		for _, e := range l {
+			w.Write([]byte(e + "\n"))
+		}
+		return
+	}
+	if k == "" {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 	switch r.Method {
 	case http.MethodGet:
-		b, err := client.Get(k)
+		c := r.Header.Get("X-Acdb-Consistency")
+		if c != "" && c != "cache" && c != "strong" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("main: X-Acdb-Consistency must be cache or strong"))
+			return
+		}
+		if c == "strong" {
+			// Reading the value from disk refreshes the cache, the value is then opened with its metadata below.
+			if _, err := client.GetDirect(k); err != nil {
+				w.WriteHeader(status(err))
+				w.Write([]byte(err.Error()))
+				return
+			}
+		}
+		f, b, err := client.OpenMeta(k)
 		if err != nil {
-			w.WriteHeader(http.StatusNotFound)
+			w.WriteHeader(status(err))
+			w.Write([]byte(err.Error()))
+			return
+		}
+		defer f.Close()
+		m := decodeMeta(b)
+		pretty := *flPretty || r.URL.Query().Get("pretty") == "1"
+		// A value stored gzip encoded is sent as it is if the client accepts it and nothing needs to read it.
+		gz := m.Encoding == "gzip"
+		if gz {
+			w.Header().Add("Vary", "Accept-Encoding")
+		}
+		raw := gz && len(hooks) == 0 && !pretty && acceptsGzip(r)
+		if m.Type != "" {
+			w.Header().Set("Content-Type", m.Type)
+		}
+		if raw {
+			w.Header().Set("Content-Encoding", "gzip")
+			// Left unset, the type would be sniffed from the compressed bytes as application/x-gzip.
+			if m.Type == "" {
+				w.Header().Set("Content-Type", "application/octet-stream")
+			}
+		}
+		if len(hooks) == 0 && !pretty && gz == raw {
+			http.ServeContent(w, r, "", time.Time{}, f)
+			return
+		}
+		if b, err = ioutil.ReadAll(f); err != nil {
+			w.Header().Del("Content-Type")
+			w.Header().Del("Content-Encoding")
+			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
 			return
 		}
-		w.Write(b)
+		if gz && !raw {
+			if b, err = gunzip(b); err != nil {
+				w.Header().Del("Content-Type")
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(err.Error()))
+				return
+			}
+		}
+		for _, h := range hooks {
+			if b, err = h.OnGet(k, b); err != nil {
+				w.Header().Del("Content-Type")
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(err.Error()))
+				return
+			}
+		}
+		if pretty {
+			buf := &bytes.Buffer{}
+			if json.Indent(buf, b, "", "    ") == nil {
+				b = append(buf.Bytes(), '\n')
+			}
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
+	case http.MethodHead:
+		// The size is found by seeking to the end, so the value is not read.
+		f, b, err := client.OpenMeta(k)
+		if err != nil {
+			w.WriteHeader(status(err))
+			return
+		}
+		n, err := f.Seek(0, io.SeekEnd)
+		f.Close()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		m := decodeMeta(b)
+		if m.Type != "" {
+			w.Header().Set("Content-Type", m.Type)
+		}
+		if m.Encoding == "gzip" {
+			w.Header().Add("Vary", "Accept-Encoding")
+			if !acceptsGzip(r) {
+				// The decoded length is unknown without decompressing.
+				return
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
 	case http.MethodPut:
 		b, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			w.WriteHeader(http.StatusNotFound)
+			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte(err.Error()))
 			return
 		}
-		log.Println("set", k, string(b))
-		if err := client.Set(k, b); err != nil {
-			w.WriteHeader(http.StatusNotFound)
+		enc := r.Header.Get("Content-Encoding")
+		if enc != "" && enc != "gzip" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			w.Write([]byte("main: only gzip content encoding is supported"))
+			return
+		}
+		if enc == "gzip" {
+			// A body which does not decode is refused, rather than stored and failing every GET which decodes it.
+			d, err := gunzip(b)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			if len(hooks) != 0 {
+				// Hooks see the decoded value, which is then stored decoded.
+				b = d
+				enc = ""
+			}
+		}
+		for _, h := range hooks {
+			if b, err = h.OnSet(k, b); err != nil {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				w.Write([]byte(err.Error()))
+				return
+			}
+		}
+		log.Println("set", k, len(b))
+		if err := client.SetMeta(k, b, meta{Type: r.Header.Get("Content-Type"), Encoding: enc}.encode()); err != nil {
+			w.WriteHeader(status(err))
 			w.Write([]byte(err.Error()))
 			return
 		}
 	case http.MethodDelete:
 		log.Println("del", k)
 		if err := client.Del(k); err != nil {
-			w.WriteHeader(http.StatusNotFound)
+			w.WriteHeader(status(err))
 			w.Write([]byte(err.Error()))
 			return
 		}
 	}
 }
 
+// recorder is a http.ResponseWriter remembering the status code and the number of bytes written.
+type recorder struct {
+	http.ResponseWriter
+	code int
+	size int
+}
+
+func (r *recorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.size += n
+	return n, err
+}
+
+// access wraps h and logs method, key, status, response size and duration of every request. Bodies are never logged.
+func access(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t := time.Now()
+		c := &recorder{ResponseWriter: w, code: http.StatusOK}
+		h(c, r)
+		log.Println(r.Method, key(r.URL.EscapedPath()), c.code, c.size, time.Since(t))
+	}
+}
+
+// limit wraps h and serves at most n requests at once. Requests beyond the limit are rejected with 503 Service
+// Unavailable instead of waiting.
+func limit(h http.HandlerFunc, n int) http.HandlerFunc {
+	sem := make(chan struct{}, n)
+	return func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+			h(w, r)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}
+}
+
+// cors wraps h and adds the CORS headers to requests from the allowed origins. Preflight requests are answered with 204
+// No Content without reaching h.
+func cors(h http.HandlerFunc, origins []string) http.HandlerFunc {
+	allow := func(o string) bool {
+		for _, e := range origins {
+			if e == "*" || e == o {
+				return true
+			}
+		}
+		return false
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		o := r.Header.Get("Origin")
+		if o != "" && allow(o) {
+			w.Header().Set("Access-Control-Allow-Origin", o)
+			w.Header().Add("Vary", "Origin")
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", *flCorsMethods)
+				w.Header().Set("Access-Control-Allow-Headers", *flCorsHeaders)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
 func main() {
 	flag.Parse()
-	client = acdb.Map(*flRoot)
-	http.HandleFunc("/", hand)
-	doa.Try1(http.ListenAndServe(*flListen, nil))
+	dsn := *flDsn
+	if dsn == "" {
+		switch *flDriver {
+		case "lru":
+			dsn = strconv.Itoa(*flLruSize)
+		default:
+			dsn = *flRoot
+		}
+	}
+	c, err := acdb.Open(*flDriver, dsn)
+	if err != nil {
+		log.Fatalln("main:", err)
+	}
+	client = c
+	if *flVerify {
+		l, err := client.Verify()
+		if err != nil {
+			log.Fatalln("main:", err)
+		}
+		for _, k := range l {
+			fmt.Println(k)
+		}
+		if len(l) != 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if *flJSON {
+		hooks = append(hooks, JSONHook{})
+	}
+	h := hand
+	if *flMaxConcurrent > 0 {
+		h = limit(h, *flMaxConcurrent)
+	}
+	if *flCorsOrigin != "" {
+		h = cors(h, strings.Split(strings.ReplaceAll(*flCorsOrigin, " ", ""), ","))
+	}
+	if *flAccess {
+		h = access(h)
+	}
+	http.HandleFunc("/", h)
+	srv := &http.Server{Addr: *flListen}
+	// ListenAndServe returns as soon as Shutdown starts, done is closed once the requests in flight are finished.
+	done := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		srv.Shutdown(context.Background())
+		close(done)
+	}()
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatalln("main:", err)
+	}
+	<-done
+	if err := client.Close(); err != nil {
+		log.Fatalln("main:", err)
+	}
 }
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mohanson/acdb"
+)
+
+func TestKey(t *testing.T) {
+	for p, want := range map[string]string{
+		"":                "",
+		"/":               "",
+		"//":              "",
+		"/..":             "",
+		"/foo":            "foo",
+		"foo/":            "foo",
+		"//foo":           "foo",
+		"/foo//bar/":      "foo/bar",
+		"/bar/../foo":     "foo",
+		"/../../foo":      "foo",
+		"/./foo/./bar":    "foo/bar",
+		"/foo%2Fbar":      "foo%2Fbar",
+		"/foo/bar/../baz": "foo/baz",
+	} {
+		if k := key(p); k != want {
+			t.Errorf("key(%q) = %q, want %q", p, k, want)
+		}
+	}
+}
+
+// serve sends a request to hand and returns the response.
+func serve(method string, target string, body string, header http.Header) *http.Response {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	hand(w, r)
+	return w.Result()
+}
+
+func TestHandKeys(t *testing.T) {
+	client = acdb.NewEmerge(acdb.NewMemDriver())
+	if res := serve(http.MethodPut, "/", "v", nil); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("put /: %d", res.StatusCode)
+	}
+	if res := serve(http.MethodPut, "//foo//bar/", "v", nil); res.StatusCode != http.StatusOK {
+		t.Fatalf("put: %d", res.StatusCode)
+	}
+	for _, p := range []string{"/foo/bar", "/foo/bar/", "/foo/baz/../bar"} {
+		res := serve(http.MethodGet, p, "", nil)
+		b, _ := ioutil.ReadAll(res.Body)
+		if res.StatusCode != http.StatusOK || string(b) != "v" {
+			t.Fatalf("get %s: %d %q", p, res.StatusCode, b)
+		}
+	}
+}
+
+func TestHandList(t *testing.T) {
+	root := t.TempDir()
+	client = acdb.NewEmerge(acdb.NewDocDriver(root))
+	for _, k := range []string{"a", "b", "c"} {
+		client.Set(k, nil)
+	}
+	res := serve(http.MethodGet, "/?limit=2", "", nil)
+	b, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || string(b) != "a\nb\n" {
+		t.Fatalf("first page: %d %q", res.StatusCode, b)
+	}
+	res = serve(http.MethodGet, "/?limit=2&cursor="+res.Header.Get("X-Acdb-Next"), "", nil)
+	b, _ = ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || string(b) != "c\n" || res.Header.Get("X-Acdb-Next") != "" {
+		t.Fatalf("last page: %d %q", res.StatusCode, b)
+	}
+	for _, q := range []string{"limit=0", "limit=x", "limit=1&cursor=!"} {
+		if res := serve(http.MethodGet, "/?"+q, "", nil); res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: %d", q, res.StatusCode)
+		}
+	}
+	os.RemoveAll(root)
+	if res := serve(http.MethodGet, "/?limit=1", "", nil); res.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("driver error: %d", res.StatusCode)
+	}
+	client = acdb.NewEmerge(acdb.NewLruDriver(1))
+	if res := serve(http.MethodGet, "/", "", nil); res.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("unsupported: %d", res.StatusCode)
+	}
+}
+
+func TestHandBinary(t *testing.T) {
+	client = acdb.NewEmerge(acdb.NewMemDriver())
+	v := make([]byte, 4096)
+	rand.New(rand.NewSource(42)).Read(v)
+	if res := serve(http.MethodPut, "/bin", string(v), nil); res.StatusCode != http.StatusOK {
+		t.Fatalf("put: %d", res.StatusCode)
+	}
+	res := serve(http.MethodGet, "/bin", "", nil)
+	b, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || !bytes.Equal(b, v) {
+		t.Fatalf("get: %d, %d bytes differ", res.StatusCode, len(b))
+	}
+}
+
+func TestHandGzip(t *testing.T) {
+	client = acdb.NewEmerge(acdb.NewMemDriver())
+	gz := http.Header{"Content-Encoding": {"gzip"}}
+	if res := serve(http.MethodPut, "/k", "not gzip", gz); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("put invalid: %d", res.StatusCode)
+	}
+	buf := &bytes.Buffer{}
+	z := gzip.NewWriter(buf)
+	z.Write([]byte("value"))
+	z.Close()
+	if res := serve(http.MethodPut, "/k", buf.String(), gz); res.StatusCode != http.StatusOK {
+		t.Fatalf("put: %d", res.StatusCode)
+	}
+	res := serve(http.MethodGet, "/k", "", http.Header{"Accept-Encoding": {"gzip"}})
+	b, _ := ioutil.ReadAll(res.Body)
+	if res.Header.Get("Content-Encoding") != "gzip" || !bytes.Equal(b, buf.Bytes()) {
+		t.Fatalf("get raw: %v %q", res.Header, b)
+	}
+	if c := res.Header.Get("Content-Type"); c != "application/octet-stream" {
+		t.Fatalf("get raw: content type %s", c)
+	}
+	res = serve(http.MethodGet, "/k", "", nil)
+	b, _ = ioutil.ReadAll(res.Body)
+	if res.Header.Get("Content-Encoding") != "" || string(b) != "value" {
+		t.Fatalf("get decoded: %v %q", res.Header, b)
+	}
+	res = serve(http.MethodGet, "/", "", nil)
+	if b, _ := ioutil.ReadAll(res.Body); string(b) != "k\n" {
+		t.Fatalf("list: %q", b)
+	}
+	// A plain PUT replaces the encoding together with the value.
+	serve(http.MethodPut, "/k", "plain", nil)
+	res = serve(http.MethodGet, "/k", "", http.Header{"Accept-Encoding": {"gzip"}})
+	b, _ = ioutil.ReadAll(res.Body)
+	if res.Header.Get("Content-Encoding") != "" || string(b) != "plain" {
+		t.Fatalf("get plain: %v %q", res.Header, b)
+	}
+}
+
+func TestHandType(t *testing.T) {
+	d := acdb.NewDocDriver(t.TempDir())
+	client = acdb.NewEmerge(d)
+	if res := serve(http.MethodPut, "/foo", "v", http.Header{"Content-Type": {"text/x-foo"}}); res.StatusCode != 200 {
+		t.Fatalf("put: %d", res.StatusCode)
+	}
+	if res := serve(http.MethodPut, "/foo~meta", "{}", nil); res.StatusCode != http.StatusBadRequest {
+		t.Fatal("put into the metadata accepted")
+	}
+	for _, m := range []string{http.MethodGet, http.MethodHead} {
+		if res := serve(m, "/foo", "", nil); res.Header.Get("Content-Type") != "text/x-foo" {
+			t.Fatalf("%s: content type %q", m, res.Header.Get("Content-Type"))
+		}
+	}
+	res := serve(http.MethodGet, "/", "", nil)
+	if b, _ := ioutil.ReadAll(res.Body); string(b) != "foo\n" {
+		t.Fatalf("list: %q", b)
+	}
+	// The key fits the limit of the driver, its metadata does not: nothing is stored.
+	k := "/" + strings.Repeat("k", 252)
+	if res := serve(http.MethodPut, k, "v", http.Header{"Content-Type": {"text/plain"}}); res.StatusCode != http.StatusBadRequest {
+		t.Fatal("put with too long metadata accepted")
+	}
+	if res := serve(http.MethodGet, k, "", nil); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("get: %d", res.StatusCode)
+	}
+	serve(http.MethodDelete, "/foo", "", nil)
+	if l, _ := d.Keys(); len(l) != 0 {
+		t.Fatalf("keys left: %q", l)
+	}
+}
+
+func TestHandPutStatus(t *testing.T) {
+	client = acdb.NewEmerge(acdb.NewDocDriverByteCapped(t.TempDir(), 4))
+	if res := serve(http.MethodPut, "/k", "too large", nil); res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("put too large: %d", res.StatusCode)
+	}
+	f := acdb.NewFaultDriver(acdb.NewMemDriver())
+	f.FailKey("set", "k", errors.New("disk"))
+	client = acdb.NewEmerge(f)
+	if res := serve(http.MethodPut, "/k", "v", nil); res.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("put failing: %d", res.StatusCode)
+	}
+}
+
+func TestHTTPDriver(t *testing.T) {
+	f := acdb.NewFaultDriver(acdb.NewMemDriver())
+	client = acdb.NewEmerge(f)
+	srv := httptest.NewServer(http.HandlerFunc(hand))
+	defer srv.Close()
+	d := acdb.NewHTTPDriver(srv.URL, nil)
+	for _, k := range []string{"a?b", "a#b", "a%b", "a b/c"} {
+		if err := d.Set(k, []byte(k)); err != nil {
+			t.Fatalf("set %q: %v", k, err)
+		}
+		if v, err := d.Get(k); err != nil || string(v) != k {
+			t.Fatalf("get %q: %q, %v", k, v, err)
+		}
+	}
+	if _, err := d.Get("none"); !acdb.IsNotExist(err) {
+		t.Fatalf("get missing: %v", err)
+	}
+	if err := d.Del("none"); !acdb.IsNotExist(err) {
+		t.Fatalf("del missing: %v", err)
+	}
+	f.FailKey("get", "a%3Fb", errors.New("disk"))
+	if _, err := d.Get("a?b"); err == nil || acdb.IsNotExist(err) {
+		t.Fatalf("get failing: %v", err)
+	}
+	if err := d.Set("a~meta", []byte("v")); err == nil {
+		t.Fatal("set reserved key accepted")
+	}
+
+	client = acdb.NewEmerge(acdb.NewMemDriver())
+	client.SetMeta("a?b", []byte("v"), []byte(`{"type":"text/plain"}`))
+	client.SetTimestamped("c", []byte("v"), time.Now())
+	l, err := d.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(l)
+	if strings.Join(l, ",") != "a?b,c" {
+		t.Fatalf("keys: %q", l)
+	}
+}
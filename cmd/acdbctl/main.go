@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var (
+	flServer = flag.String("server", "http://127.0.0.1:8080", "server address")
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: acdbctl [-server url] get <key>")
+	fmt.Fprintln(os.Stderr, "       acdbctl [-server url] set <key> [file]")
+	fmt.Fprintln(os.Stderr, "       acdbctl [-server url] del <key>")
+	fmt.Fprintln(os.Stderr, "       acdbctl [-server url] list")
+	os.Exit(2)
+}
+
+// call sends the request and copies the response body to stdout. Every segment of the key is escaped like HTTPDriver
+// does, so a key containing "?", "#" or "%" reaches the server as it is. It exits with code 1 if the server does not
+// answer with 200 OK.
+func call(method string, k string, body io.Reader) {
+	l := strings.Split(k, "/")
+	for i, e := range l {
+		l[i] = url.PathEscape(e)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(*flServer, "/")+"/"+strings.Join(l, "/"), body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(res.Body)
+		fmt.Fprintf(os.Stderr, "%s: %s\n", res.Status, b)
+		os.Exit(1)
+	}
+	if _, err := io.Copy(os.Stdout, res.Body); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func main() {
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+	}
+	switch {
+	case args[0] == "get" && len(args) == 2:
+		call(http.MethodGet, args[1], nil)
+	case args[0] == "set" && len(args) == 2:
+		call(http.MethodPut, args[1], os.Stdin)
+	case args[0] == "set" && len(args) == 3:
+		f, err := os.Open(args[2])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		call(http.MethodPut, args[1], f)
+	case args[0] == "del" && len(args) == 2:
+		call(http.MethodDelete, args[1], nil)
+	case args[0] == "list" && len(args) == 1:
+		call(http.MethodGet, "", nil)
+	default:
+		usage()
+	}
+}
@@ -5,3 +5,4 @@ if [ ! -d ./bin ]; then
 fi
 
 go build -o bin github.com/mohanson/acdb/cmd/acdb
+go build -o bin github.com/mohanson/acdb/cmd/acdbctl
@@ -2,7 +2,4 @@ module github.com/mohanson/acdb
 
 go 1.16
 
-require (
-	github.com/mohanson/doa v0.0.0-20210110060319-44d367da3ecb
-	github.com/mohanson/lru v0.0.0-20201114092131-d8316afe1dbb
-)
+require github.com/mohanson/doa v0.0.0-20210110060319-44d367da3ecb